@@ -0,0 +1,309 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: api/v1/recorder.proto
+
+package recorder_v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// RecorderClient is the client API for Recorder service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RecorderClient interface {
+	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
+	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
+	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Recorder_ProduceStreamClient, error)
+	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Recorder_ConsumeStreamClient, error)
+	GetOffsets(ctx context.Context, in *GetOffsetsRequest, opts ...grpc.CallOption) (*GetOffsetsResponse, error)
+}
+
+type recorderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRecorderClient(cc grpc.ClientConnInterface) RecorderClient {
+	return &recorderClient{cc}
+}
+
+func (c *recorderClient) Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error) {
+	out := new(ProduceResponse)
+	err := c.cc.Invoke(ctx, "/recorder.v1.Recorder/Produce", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recorderClient) Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error) {
+	out := new(ConsumeResponse)
+	err := c.cc.Invoke(ctx, "/recorder.v1.Recorder/Consume", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recorderClient) ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Recorder_ProduceStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Recorder_ServiceDesc.Streams[0], "/recorder.v1.Recorder/ProduceStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &recorderProduceStreamClient{stream}
+	return x, nil
+}
+
+type Recorder_ProduceStreamClient interface {
+	Send(*ProduceRequest) error
+	Recv() (*ProduceResponse, error)
+	grpc.ClientStream
+}
+
+type recorderProduceStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *recorderProduceStreamClient) Send(m *ProduceRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *recorderProduceStreamClient) Recv() (*ProduceResponse, error) {
+	m := new(ProduceResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *recorderClient) ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Recorder_ConsumeStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Recorder_ServiceDesc.Streams[1], "/recorder.v1.Recorder/ConsumeStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &recorderConsumeStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Recorder_ConsumeStreamClient interface {
+	Recv() (*ConsumeResponse, error)
+	grpc.ClientStream
+}
+
+type recorderConsumeStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *recorderConsumeStreamClient) Recv() (*ConsumeResponse, error) {
+	m := new(ConsumeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *recorderClient) GetOffsets(ctx context.Context, in *GetOffsetsRequest, opts ...grpc.CallOption) (*GetOffsetsResponse, error) {
+	out := new(GetOffsetsResponse)
+	err := c.cc.Invoke(ctx, "/recorder.v1.Recorder/GetOffsets", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RecorderServer is the server API for Recorder service.
+// All implementations must embed UnimplementedRecorderServer
+// for forward compatibility
+type RecorderServer interface {
+	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
+	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
+	ProduceStream(Recorder_ProduceStreamServer) error
+	ConsumeStream(*ConsumeRequest, Recorder_ConsumeStreamServer) error
+	GetOffsets(context.Context, *GetOffsetsRequest) (*GetOffsetsResponse, error)
+	mustEmbedUnimplementedRecorderServer()
+}
+
+// UnimplementedRecorderServer must be embedded to have forward compatible implementations.
+type UnimplementedRecorderServer struct {
+}
+
+func (UnimplementedRecorderServer) Produce(context.Context, *ProduceRequest) (*ProduceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Produce not implemented")
+}
+func (UnimplementedRecorderServer) Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Consume not implemented")
+}
+func (UnimplementedRecorderServer) ProduceStream(Recorder_ProduceStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
+}
+func (UnimplementedRecorderServer) ConsumeStream(*ConsumeRequest, Recorder_ConsumeStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ConsumeStream not implemented")
+}
+func (UnimplementedRecorderServer) GetOffsets(context.Context, *GetOffsetsRequest) (*GetOffsetsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOffsets not implemented")
+}
+func (UnimplementedRecorderServer) mustEmbedUnimplementedRecorderServer() {}
+
+// UnsafeRecorderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RecorderServer will
+// result in compilation errors.
+type UnsafeRecorderServer interface {
+	mustEmbedUnimplementedRecorderServer()
+}
+
+func RegisterRecorderServer(s grpc.ServiceRegistrar, srv RecorderServer) {
+	s.RegisterService(&Recorder_ServiceDesc, srv)
+}
+
+func _Recorder_Produce_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecorderServer).Produce(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/recorder.v1.Recorder/Produce",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecorderServer).Produce(ctx, req.(*ProduceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Recorder_Consume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConsumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecorderServer).Consume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/recorder.v1.Recorder/Consume",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecorderServer).Consume(ctx, req.(*ConsumeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Recorder_ProduceStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RecorderServer).ProduceStream(&recorderProduceStreamServer{stream})
+}
+
+type Recorder_ProduceStreamServer interface {
+	Send(*ProduceResponse) error
+	Recv() (*ProduceRequest, error)
+	grpc.ServerStream
+}
+
+type recorderProduceStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *recorderProduceStreamServer) Send(m *ProduceResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *recorderProduceStreamServer) Recv() (*ProduceRequest, error) {
+	m := new(ProduceRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Recorder_ConsumeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ConsumeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RecorderServer).ConsumeStream(m, &recorderConsumeStreamServer{stream})
+}
+
+type Recorder_ConsumeStreamServer interface {
+	Send(*ConsumeResponse) error
+	grpc.ServerStream
+}
+
+type recorderConsumeStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *recorderConsumeStreamServer) Send(m *ConsumeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Recorder_GetOffsets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOffsetsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecorderServer).GetOffsets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/recorder.v1.Recorder/GetOffsets",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecorderServer).GetOffsets(ctx, req.(*GetOffsetsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Recorder_ServiceDesc is the grpc.ServiceDesc for Recorder service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Recorder_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "recorder.v1.Recorder",
+	HandlerType: (*RecorderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Produce",
+			Handler:    _Recorder_Produce_Handler,
+		},
+		{
+			MethodName: "Consume",
+			Handler:    _Recorder_Consume_Handler,
+		},
+		{
+			MethodName: "GetOffsets",
+			Handler:    _Recorder_GetOffsets_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ProduceStream",
+			Handler:       _Recorder_ProduceStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ConsumeStream",
+			Handler:       _Recorder_ConsumeStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/v1/recorder.proto",
+}
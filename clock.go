@@ -0,0 +1,21 @@
+package recorder
+
+import "time"
+
+// Clock tells time for segment timestamps and background jobs,
+// so that tests can control time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock tells wall clock time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,280 @@
+package recorder
+
+import (
+	"log"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/comfforts/errors"
+	api "github.com/comfforts/recorder/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ERROR_COMPACTING_SEGMENT string = "error compacting segment %d"
+)
+
+// RECORD_TYPE_TOMBSTONE marks a record deleting its key
+const RECORD_TYPE_TOMBSTONE uint32 = math.MaxUint32
+
+// COMPACT_EXT suffixes segment files being written by compaction
+const COMPACT_EXT = ".compact"
+
+// compactor compacts sealed segments every interval, until done is closed
+func (r *recorder) compactor(done <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.Config.clock().After(interval):
+			if err := r.Compact(); err != nil {
+				log.Printf("recorder.compactor() - error compacting segments, error: %v", err)
+			}
+		}
+	}
+}
+
+// Compact rewrites sealed segments keeping only the latest record per key.
+// Records without key are kept, offsets of kept records are preserved.
+// Tombstones are dropped once their segment is older than tombstone retention.
+func (r *recorder) Compact() error {
+	if r.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	r.cmu.Lock()
+	defer r.cmu.Unlock()
+
+	r.mu.RLock()
+	segments := append([]Segmenter{}, r.segments...)
+	active, done, discards := r.activeSegment, r.done, r.discards
+	// segments' newest record times, updated by appends to segments reopened by truncation
+	appended := make([]time.Time, len(segments))
+	for i, s := range segments {
+		appended[i] = s.LastAppended()
+	}
+	r.mu.RUnlock()
+	if done == nil {
+		return ErrRecorderClosed
+	}
+
+	// latest offset of every key across the log
+	latest := map[string]uint64{}
+	for _, s := range segments {
+		f := s.Filer()
+		if err := scanRecords(f, func(record *api.Record) {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+		}); err != nil {
+			// segment cut, sealed or removed while scanning
+			if r.discarded(discards) || r.filerChanged(s, f) {
+				return nil
+			}
+			log.Printf("recorder.Compact() - error scanning segment, base offset: %d, error: %v", s.BaseOffset(), err)
+			return err
+		}
+	}
+
+	cutoff := r.Config.clock().Now().Add(-r.Config.Compaction.TombstoneRetention)
+	for i, s := range segments {
+		if s == active {
+			break
+		}
+		expired := appended[i].Before(cutoff)
+		keep := func(record *api.Record) bool {
+			if len(record.Key) == 0 {
+				return true
+			}
+			if latest[string(record.Key)] != record.Offset {
+				return false
+			}
+			return record.Type != RECORD_TYPE_TOMBSTONE || !expired
+		}
+		if err := r.compactSegment(s, keep, discards); err != nil {
+			log.Printf("recorder.Compact() - error compacting segment, base offset: %d, error: %v", s.BaseOffset(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSegment rewrites segment s with records kept by keep, swapping
+// the compacted segment in. Segment is left as is if every record is kept,
+// or if records were discarded since the log was scanned with discards.
+func (r *recorder) compactSegment(s Segmenter, keep func(record *api.Record) bool, discards uint64) error {
+	// segment as scanned, a segment cut or reopened meanwhile isn't swapped
+	r.mu.RLock()
+	idx, active, done := r.segmentIndex(s), r.activeSegment, r.done
+	next, size, name := s.NextOffset(), s.Filer().Size(), s.Filer().Name()
+	stale := r.discards != discards
+	r.mu.RUnlock()
+	if done == nil {
+		return ErrRecorderClosed
+	}
+	// segment removed, or cut into the active segment, since compaction started.
+	// Latest records of keys may have been discarded, leaving older records to keep.
+	if idx < 0 || s == active || stale {
+		return nil
+	}
+
+	var kept []*api.Record
+	var dropped int
+	f := s.Filer()
+	if err := scanRecords(f, func(record *api.Record) {
+		if keep(record) {
+			kept = append(kept, record)
+			return
+		}
+		dropped++
+	}); err != nil {
+		if r.discarded(discards) || r.filerChanged(s, f) {
+			return nil
+		}
+		return err
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	// compacted segment is written aside, then renamed over segment files
+	base := strings.TrimSuffix(name, path.Ext(name))
+	fPath, iPath, tPath := base+FILER_EXT, base+INDEX_EXT, base+TIME_INDEX_EXT
+	cfPath, ciPath, ctPath := fPath+COMPACT_EXT, iPath+COMPACT_EXT, tPath+COMPACT_EXT
+	cleanup := func() {
+		r.Config.fs().Remove(cfPath)
+		r.Config.fs().Remove(ciPath)
+		r.Config.fs().Remove(ctPath)
+	}
+	if len(kept) > 0 {
+		cs, err := openSegmenter(cfPath, ciPath, ctPath, s.BaseOffset(), r.Config)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		for _, record := range kept {
+			if err = cs.write(record); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = cs.Sync()
+		}
+		if cerr := cs.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			cleanup()
+			return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		cleanup()
+		return ErrRecorderClosed
+	}
+
+	// segment removed while compacting
+	if idx = r.segmentIndex(s); idx < 0 {
+		cleanup()
+		return nil
+	}
+	// segment truncated, and possibly reopened for appends, while compacting
+	if r.discards != discards || s == r.activeSegment || s.NextOffset() != next || s.Filer().Size() != size {
+		log.Printf("recorder.compactSegment() - segment changed while compacting, discarding compacted segment, base offset: %d", s.BaseOffset())
+		cleanup()
+		return nil
+	}
+
+	log.Printf("recorder.compactSegment() - swapping compacted segment, base offset: %d, kept: %d, dropped: %d", s.BaseOffset(), len(kept), dropped)
+	if len(kept) == 0 {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		r.segments = append(r.segments[:idx], r.segments[idx+1:]...)
+		return r.syncDir()
+	}
+
+	if err := s.Close(); err != nil {
+		cleanup()
+		return err
+	}
+	// filer goes first, a stale index is rebuilt from the compacted filer on open
+	if err := r.Config.fs().Rename(cfPath, fPath); err != nil {
+		cleanup()
+		return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+	}
+	// a stale compressed filer is also removed on open
+	if name != fPath {
+		if err := r.Config.fs().Remove(name); err != nil {
+			return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+		}
+	}
+	if err := r.Config.fs().Rename(ciPath, iPath); err != nil {
+		return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+	}
+	if err := r.Config.fs().Rename(ctPath, tPath); err != nil {
+		return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+	}
+	if err := r.syncDir(); err != nil {
+		return errors.WrapError(err, ERROR_COMPACTING_SEGMENT, s.BaseOffset())
+	}
+	cs, err := openSegmenter(fPath, iPath, tPath, s.BaseOffset(), r.Config)
+	if err != nil {
+		return err
+	}
+	if err = cs.Close(); err != nil {
+		return err
+	}
+	r.segments[idx] = cs
+	if r.Config.Compression.Enabled {
+		r.compress(cs)
+	}
+	return nil
+}
+
+// segmentIndex returns the position of segment s in segments, -1 if it's removed
+func (r *recorder) segmentIndex(s Segmenter) int {
+	for i, segment := range r.segments {
+		if segment == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// discarded checks if appended records were discarded since discards were counted
+func (r *recorder) discarded(discards uint64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.discards != discards
+}
+
+// filerChanged checks if segment s was removed, or its filer f closed or swapped, since f was read
+func (r *recorder) filerChanged(s Segmenter, f Filer) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.segmentIndex(s) < 0 || s.Filer() != f
+}
+
+// scanRecords calls fn with every record in segment filer f
+func scanRecords(f Filer, fn func(record *api.Record)) error {
+	var uerr error
+	if _, err := f.Scan(0, func(_ uint64, p []byte) bool {
+		record := &api.Record{}
+		if uerr = proto.Unmarshal(p, record); uerr != nil {
+			return false
+		}
+		fn(record)
+		return true
+	}); err != nil {
+		return err
+	}
+	if uerr != nil {
+		return errors.WrapError(uerr, ERROR_UNMARSHALLING_RECORD)
+	}
+	return nil
+}
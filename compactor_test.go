@@ -0,0 +1,273 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+func TestCompact(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := Config{Clock: clock}
+	c.Segment.MaxIndexSize = 3
+	c.Compaction.TombstoneRetention = time.Hour
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	// segments [0, 2], [3, 5], [6, 8] are sealed, [9] is active
+	records := []*api.Record{
+		{Key: []byte("k1"), Value: []byte("a")},
+		{Key: []byte("k2"), Value: []byte("a")},
+		{Value: []byte("no key")},
+		{Key: []byte("k1"), Value: []byte("b")},
+		{Key: []byte("k3"), Value: []byte("a")},
+		{Key: []byte("k2"), Type: RECORD_TYPE_TOMBSTONE},
+		{Key: []byte("k3"), Value: []byte("b")},
+		{Key: []byte("k4"), Value: []byte("a")},
+		{Key: []byte("k4"), Value: []byte("b")},
+		{Key: []byte("k1"), Value: []byte("c")},
+	}
+	for _, record := range records {
+		_, err = r.Append(record)
+		require.NoError(t, err)
+	}
+	size := r.DiskSize()
+
+	requireOffsets := func(r Recorder, kept, dropped []uint64) {
+		for _, off := range kept {
+			record, err := r.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, records[off].Key, record.Key)
+			require.Equal(t, records[off].Value, record.Value)
+		}
+		for _, off := range dropped {
+			_, err := r.Read(off)
+			require.Error(t, err)
+		}
+	}
+
+	// latest record per key is kept, with its original offset
+	err = r.Compact()
+	require.NoError(t, err)
+	requireOffsets(r, []uint64{2, 5, 6, 8, 9}, []uint64{0, 1, 3, 4, 7})
+	require.Less(t, r.DiskSize(), size)
+
+	// tombstone is dropped after tombstone retention, emptied segment is removed
+	clock.Advance(2 * time.Hour)
+	err = r.Compact()
+	require.NoError(t, err)
+	requireOffsets(r, []uint64{2, 6, 8, 9}, []uint64{5})
+	r.mu.RLock()
+	require.Equal(t, 3, len(r.segments))
+	r.mu.RUnlock()
+
+	err = r.Close()
+	require.NoError(t, err)
+
+	// interrupted compaction files are discarded on setup
+	err = os.WriteFile(path.Join(dir, fmt.Sprintf("6%s%s", FILER_EXT, COMPACT_EXT)), []byte("partial"), 0644)
+	require.NoError(t, err)
+
+	// compacted segments are reopened
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	requireOffsets(r, []uint64{2, 6, 8, 9}, []uint64{0, 1, 3, 4, 5, 7})
+
+	off, err := r.Append(&api.Record{Key: []byte("k4"), Value: []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.NotEqual(t, COMPACT_EXT, path.Ext(file.Name()))
+	}
+}
+
+// hookFS calls open with names of opened files
+type hookFS struct {
+	FS
+	open func(name string)
+}
+
+func (h *hookFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	h.open(name)
+	return h.FS.OpenFile(name, flag, perm)
+}
+
+func TestCompactTruncated(t *testing.T) {
+	dir := "mem-data"
+	var r Recorder
+	var once sync.Once
+	fsys := &hookFS{FS: NewMemFS(), open: func(name string) {}}
+
+	c := Config{FS: fsys}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	// record 4 is the only record kept in segment [3, 5]
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Key: []byte(fmt.Sprintf("k%d", i%2)), Value: []byte(fmt.Sprintf("v%d", i))}
+		if i == 4 {
+			record.Key = nil
+		}
+		_, err = r.Append(record)
+		require.NoError(t, err)
+	}
+
+	// segment [3, 5] is cut and made active while it's compacted
+	fsys.open = func(name string) {
+		if strings.HasPrefix(path.Base(name), "3") && strings.HasSuffix(name, COMPACT_EXT) {
+			once.Do(func() {
+				require.NoError(t, r.TruncateAfter(4))
+			})
+		}
+	}
+	err = r.Compact()
+	require.NoError(t, err)
+
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	for off := uint64(3); off < 5; off++ {
+		record, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("v%d", off), string(record.Value))
+	}
+	_, err = r.Read(5)
+	require.Error(t, err)
+
+	off, err := r.Append(&api.Record{Value: []byte("v5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	record, err := r.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v5"), record.Value)
+}
+
+func TestCompactorClose(t *testing.T) {
+	dir := "mem-data"
+	mfs := NewMemFS()
+	fsys := &hookFS{FS: mfs, open: func(name string) {}}
+
+	clock := newFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := Config{Clock: clock, FS: fsys}
+	c.Segment.MaxIndexSize = 3
+	c.Compaction.Interval = time.Minute
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = r.Append(&api.Record{Key: []byte(fmt.Sprintf("k%d", i%2)), Value: []byte(fmt.Sprintf("v%d", i))})
+		require.NoError(t, err)
+	}
+
+	// background compaction is held while writing a compacted segment
+	compacting, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fsys.open = func(name string) {
+		if strings.HasSuffix(name, COMPACT_EXT) {
+			once.Do(func() {
+				close(compacting)
+				<-release
+			})
+		}
+	}
+	require.Eventually(t, func() bool { return clock.waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	<-compacting
+
+	// close waits for the compaction, which leaves segments as they are
+	closed := make(chan error)
+	go func() {
+		closed <- r.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("recorder closed while compacting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-closed)
+
+	entries, err := mfs.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NotEqual(t, COMPACT_EXT, path.Ext(e.Name()))
+	}
+	// emptied segments [0, 2], [3, 5] were removed before the held compaction
+	r, err = NewRecorder(dir, Config{FS: mfs})
+	require.NoError(t, err)
+	defer r.Close()
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	for off := uint64(6); off < 10; off++ {
+		record, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("v%d", off), string(record.Value))
+	}
+}
+
+func TestCompactConcurrentAppend(t *testing.T) {
+	c := Config{FS: NewMemFS()}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder("mem-data", c)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// appends and truncations, reopening sealed segments, run alongside compactions
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			off, err := r.Append(&api.Record{Key: []byte(fmt.Sprintf("k%d", i%3)), Value: []byte(fmt.Sprintf("v%d", i))})
+			if !assert.NoError(t, err) {
+				return
+			}
+			// the last append isn't truncated, it stays readable
+			if i%5 == 3 {
+				assert.NoError(t, r.TruncateAfter(off-3))
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		require.NoError(t, r.Compact())
+	}
+
+	// compacted log reads through, up to the last appended record
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	it := r.Iterator(lowest, highest)
+	var last *api.Record
+	for it.Next() {
+		last = it.Record()
+	}
+	require.NoError(t, it.Err())
+	require.NotNil(t, last)
+	require.Equal(t, highest, last.Offset)
+}
@@ -1,10 +1,98 @@
 package recorder
 
+import "time"
+
+// SyncPolicy specifies when appended records are synced to disk
+type SyncPolicy int
+
+const (
+	// SYNC_OS leaves syncing appended records to the OS
+	SYNC_OS SyncPolicy = iota
+	// SYNC_ALWAYS syncs every appended record before it's acknowledged
+	SYNC_ALWAYS
+	// SYNC_BATCH syncs after MaxRecords unsynced records or MaxInterval since last sync
+	SYNC_BATCH
+)
+
+// IndexFormat specifies how segment index files are accessed
+type IndexFormat int
+
+const (
+	// INDEX_FILE writes index entries to file, looking offsets up in memory
+	INDEX_FILE IndexFormat = iota
+	// INDEX_MMAP memory maps a preallocated index file, looking offsets up with binary search
+	INDEX_MMAP
+)
+
 type Config struct {
 	Segment struct {
 		// MaxIndexSize specifies the maximum number of entries in a segment.
 		MaxIndexSize uint64
 		// InitialOffset specifies the starting offset
 		InitialOffset uint64
+		// MaxStoreBytes specifies the maximum bytes of a segment's filer
+		MaxStoreBytes uint64
+		// MaxSegmentAge specifies how long a segment takes records after its first record
+		MaxSegmentAge time.Duration
+		// IndexFormat specifies how index files are accessed
+		IndexFormat IndexFormat
+	}
+	Durability struct {
+		// Policy specifies when appended records are synced to disk
+		Policy SyncPolicy
+		// MaxRecords specifies the number of unsynced records triggering a sync, for SYNC_BATCH
+		MaxRecords uint64
+		// MaxInterval specifies the time since last sync triggering a sync, for SYNC_BATCH
+		MaxInterval time.Duration
+	}
+	Read struct {
+		// MaxBytes specifies the maximum record bytes returned by a range read
+		MaxBytes uint64
+	}
+	Retention struct {
+		// MaxAge specifies how long sealed segments are kept after their newest record
+		MaxAge time.Duration
+		// CheckInterval specifies how often expired segments are removed, defaults to a minute
+		CheckInterval time.Duration
+		// MaxBytes specifies the maximum total bytes of segment files on disk
+		MaxBytes uint64
+	}
+	Compaction struct {
+		// Interval specifies how often sealed segments are compacted, zero disables background compaction
+		Interval time.Duration
+		// TombstoneRetention specifies how long tombstones are kept after their segment's newest record
+		TombstoneRetention time.Duration
+	}
+	Compression struct {
+		// Enabled compresses segments as they're sealed
+		Enabled bool
+		// BlockSize specifies the uncompressed bytes of a compressed block, defaults to 64KiB
+		BlockSize uint64
+	}
+	Encryption struct {
+		// KeyProvider provides keys encrypting segments, nil leaves new segments unencrypted
+		KeyProvider KeyProvider
+	}
+	// Clock tells time, defaults to wall clock
+	Clock Clock
+	// FS opens segment files, defaults to operating system files
+	FS FS
+	// ReadOnly opens the log for reading, sharing the directory lock with
+	// other read only recorders, mutating calls fail with ErrReadOnly.
+	// OpenReadOnly reads without the lock, alongside a writer.
+	ReadOnly bool
+}
+
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return osFS{}
+	}
+	return c.FS
+}
+
+func (c Config) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
 	}
+	return c.Clock
 }
@@ -0,0 +1,397 @@
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/comfforts/errors"
+	api "github.com/comfforts/recorder/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const ERROR_CRASHED string = "crashed"
+
+var ErrCrashed = errors.NewAppError(ERROR_CRASHED)
+
+// crashFS: in memory FS counting mutating file operations, crashing at the
+// crashAt-th operation. Crashing write lands half its bytes, every later operation
+// fails. File contents are durable up to their last sync, file creation, rename
+// and removal are durable once their directory is synced.
+type crashFS struct {
+	*memFS
+	mu      sync.Mutex
+	ops     int
+	crashAt int
+	crashed bool
+	durable map[*memNode][]byte
+	// directory entries as of their directory's last sync
+	entries map[string]*memNode
+}
+
+func newCrashFS(crashAt int) *crashFS {
+	return &crashFS{
+		memFS:   NewMemFS(),
+		crashAt: crashAt,
+		durable: map[*memNode][]byte{},
+		entries: map[string]*memNode{},
+	}
+}
+
+// step counts a mutating operation, failing it at and after the crash point.
+// Crash is set for the operation crashing the FS.
+func (c *crashFS) step() (crash bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return false, ErrCrashed
+	}
+	c.ops++
+	if c.ops == c.crashAt {
+		c.crashed = true
+		return true, ErrCrashed
+	}
+	return false, nil
+}
+
+// image returns the files surviving the crash, with synced contents only after power loss
+func (c *crashFS) image(powerLoss bool) *memFS {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.memFS.mu.Lock()
+	defer c.memFS.mu.Unlock()
+
+	m := NewMemFS()
+	files := c.memFS.files
+	if powerLoss {
+		files = c.entries
+	}
+	for name, n := range files {
+		n.mu.Lock()
+		data := n.data
+		if powerLoss {
+			data = c.durable[n]
+		}
+		m.files[name] = &memNode{data: append([]byte{}, data...), modTime: n.modTime}
+		n.mu.Unlock()
+	}
+	return m
+}
+
+func (c *crashFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := c.memFS.Stat(name); err != nil && flag&os.O_CREATE != 0 {
+		if _, err := c.step(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := c.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{File: f, fsys: c}, nil
+}
+
+func (c *crashFS) Rename(oldpath, newpath string) error {
+	if _, err := c.step(); err != nil {
+		return err
+	}
+	return c.memFS.Rename(oldpath, newpath)
+}
+
+func (c *crashFS) Remove(name string) error {
+	if _, err := c.step(); err != nil {
+		return err
+	}
+	return c.memFS.Remove(name)
+}
+
+func (c *crashFS) RemoveAll(p string) error {
+	if _, err := c.step(); err != nil {
+		return err
+	}
+	return c.memFS.RemoveAll(p)
+}
+
+// SyncDir makes entries of directory name durable
+func (c *crashFS) SyncDir(name string) error {
+	if _, err := c.step(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.memFS.mu.Lock()
+	defer c.memFS.mu.Unlock()
+
+	dir := path.Clean(name)
+	for fName := range c.entries {
+		if path.Dir(fName) == dir {
+			delete(c.entries, fName)
+		}
+	}
+	for fName, n := range c.memFS.files {
+		if path.Dir(fName) == dir {
+			c.entries[fName] = n
+		}
+	}
+	return nil
+}
+
+// crashFile: File of a crashFS
+type crashFile struct {
+	File
+	fsys *crashFS
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	if crash, err := f.fsys.step(); err != nil {
+		if crash {
+			f.File.Write(p[:len(p)/2])
+		}
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if crash, err := f.fsys.step(); err != nil {
+		if crash {
+			f.File.WriteAt(p[:len(p)/2], off)
+		}
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	if _, err := f.fsys.step(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+// Sync makes file contents durable
+func (f *crashFile) Sync() error {
+	if _, err := f.fsys.step(); err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	n := f.File.(*memFile).node
+	n.mu.Lock()
+	data := append([]byte{}, n.data...)
+	n.mu.Unlock()
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	f.fsys.durable[n] = data
+	return nil
+}
+
+// crashModel tracks records the log must and may hold after a crash
+type crashModel struct {
+	// acked records, readable after a crash
+	acked map[uint64]string
+	// values appended at an offset, not yet discarded by an acknowledged truncation
+	possible map[uint64]map[string]bool
+	next     uint64
+	lowest   uint64
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{
+		acked:    map[uint64]string{},
+		possible: map[uint64]map[string]bool{},
+	}
+}
+
+func (m *crashModel) appending(values ...string) {
+	for i, v := range values {
+		off := m.next + uint64(i)
+		if m.possible[off] == nil {
+			m.possible[off] = map[string]bool{}
+		}
+		m.possible[off][v] = true
+	}
+}
+
+func (m *crashModel) appended(first uint64, values ...string) {
+	for i, v := range values {
+		m.acked[first+uint64(i)] = v
+	}
+	m.next = first + uint64(len(values))
+}
+
+// truncatingAfter releases records after off, which a crashed truncation may discard
+func (m *crashModel) truncatingAfter(off uint64) {
+	for o := range m.acked {
+		if o > off {
+			delete(m.acked, o)
+		}
+	}
+}
+
+// truncatedAfter discards values after off
+func (m *crashModel) truncatedAfter(off uint64) {
+	for o := range m.possible {
+		if o > off {
+			delete(m.possible, o)
+		}
+	}
+	m.next = off + 1
+}
+
+// truncating releases records before lowest, removed with their segments
+func (m *crashModel) truncating(lowest uint64) {
+	for o := range m.acked {
+		if o < lowest {
+			delete(m.acked, o)
+		}
+	}
+}
+
+// crashWorkload appends across segment rolls, truncates and closes the recorder,
+// stopping at the first error. Acknowledged operations are applied to the model.
+func crashWorkload(dir string, c Config, m *crashModel) {
+	r, err := NewRecorder(dir, c)
+	if err != nil {
+		return
+	}
+	var n int
+	value := func() string {
+		n++
+		return fmt.Sprintf("record %d", n)
+	}
+	appendOne := func() bool {
+		v := value()
+		m.appending(v)
+		off, err := r.Append(&api.Record{Value: []byte(v)})
+		if err != nil {
+			return false
+		}
+		m.appended(off, v)
+		return true
+	}
+	appendBatch := func(k int) bool {
+		var values []string
+		var records []*api.Record
+		for i := 0; i < k; i++ {
+			values = append(values, value())
+			records = append(records, &api.Record{Value: []byte(values[i])})
+		}
+		// a crashed batch may be recovered as a prefix of its records
+		m.appending(values...)
+		first, _, err := r.AppendBatch(records)
+		if err != nil {
+			return false
+		}
+		m.appended(first, values...)
+		return true
+	}
+
+	for i := 0; i < 7; i++ {
+		if !appendOne() {
+			return
+		}
+	}
+	if !appendBatch(3) {
+		return
+	}
+	m.truncatingAfter(4)
+	if err = r.TruncateAfter(4); err != nil {
+		return
+	}
+	m.truncatedAfter(4)
+	for i := 0; i < 2; i++ {
+		if !appendOne() {
+			return
+		}
+	}
+	m.truncating(3)
+	if err = r.Truncate(3); err != nil {
+		return
+	}
+	if !appendBatch(2) {
+		return
+	}
+	r.Close()
+}
+
+// checkCrash reopens the crashed log, checking that acknowledged records are readable
+// and every record in the log was appended at its offset
+func checkCrash(t *testing.T, dir string, c Config, m *crashModel, crashAt int) {
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err, "crash at %d", crashAt)
+	defer r.Close()
+
+	for off, v := range m.acked {
+		record, err := r.Read(off)
+		require.NoError(t, err, "crash at %d, acknowledged offset %d", crashAt, off)
+		require.Equal(t, v, string(record.Value), "crash at %d, acknowledged offset %d", crashAt, off)
+	}
+
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	r.mu.RLock()
+	next := r.activeSegment.NextOffset()
+	r.mu.RUnlock()
+	for off := lowest; off < next; off++ {
+		record, err := r.Read(off)
+		require.NoError(t, err, "crash at %d, offset %d", crashAt, off)
+		require.True(t, m.possible[off][string(record.Value)], "crash at %d, phantom record at offset %d: %s", crashAt, off, record.Value)
+	}
+
+	// log takes appends after recovery
+	off, err := r.Append(&api.Record{Value: []byte("recovered")})
+	require.NoError(t, err, "crash at %d", crashAt)
+	require.Equal(t, next, off)
+}
+
+func TestCrashConsistency(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := "crash-data"
+	for _, scenario := range []struct {
+		name      string
+		powerLoss bool
+		compress  bool
+	}{
+		{name: "process crash"},
+		{name: "power loss", powerLoss: true},
+		{name: "process crash, compressed segments", compress: true},
+		{name: "power loss, compressed segments", powerLoss: true, compress: true},
+	} {
+		t.Run(scenario.name, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxIndexSize = 3
+			c.Compression.Enabled = scenario.compress
+			// acknowledged records are durable after power loss when synced
+			if scenario.powerLoss {
+				c.Durability.Policy = SYNC_ALWAYS
+			}
+
+			// counts file operations of the complete workload
+			fsys := newCrashFS(0)
+			c.FS = fsys
+			crashWorkload(dir, c, newCrashModel())
+			ops := fsys.ops
+			require.Greater(t, ops, 0)
+
+			for crashAt := 1; crashAt <= ops; crashAt++ {
+				fsys := newCrashFS(crashAt)
+				m := newCrashModel()
+				c.FS = fsys
+				crashWorkload(dir, c, m)
+				// background compressions vary the operations of a workload
+				require.True(t, fsys.crashed || scenario.compress)
+
+				c.FS = fsys.image(scenario.powerLoss)
+				checkCrash(t, dir, c, m, crashAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/comfforts/errors"
+)
+
+// segment header, the first frame of an encrypted segment's filer.
+// Header starts with a zero byte, which never starts a marshalled record.
+const (
+	SEGMENT_HEADER_MAGIC         = "\x00RECENC"
+	SEGMENT_HEADER_VERSION uint8 = 1
+	// NONCE_WIDTH + GCM tag width
+	ENCRYPTION_OVERHEAD = 12 + 16
+)
+
+const (
+	ERROR_UNKNOWN_KEY         string = "unknown encryption key %s"
+	ERROR_NO_KEY_PROVIDER     string = "no key provider for encrypted filer %s"
+	ERROR_SEGMENT_HEADER      string = "invalid segment header in %s"
+	ERROR_ENCRYPTING_RECORD   string = "error encrypting record in %s"
+	ERROR_AUTHENTICATE_RECORD string = "record authentication failed in %s at position %d"
+)
+
+// AuthenticationError is returned for encrypted records failing authentication,
+// tampered with or encrypted with a different key
+type AuthenticationError struct {
+	Name string
+	Pos  uint64
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf(ERROR_AUTHENTICATE_RECORD, e.Name, e.Pos)
+}
+
+// KeyProvider provides AES keys, 16, 24 or 32 bytes long, by key id.
+// New segments are encrypted with the current key, existing segments
+// are decrypted with the key in their header, so that keys can be rotated.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// keyRing: in memory KeyProvider
+type keyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns a KeyProvider of given keys by id, encrypting with key current
+func NewKeyRing(current string, keys map[string][]byte) KeyProvider {
+	return &keyRing{
+		current: current,
+		keys:    keys,
+	}
+}
+
+func (k *keyRing) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.current)
+	return k.current, key, err
+}
+
+func (k *keyRing) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.NewAppError(ERROR_UNKNOWN_KEY, id)
+	}
+	return key, nil
+}
+
+// cryptFiler: Filer encrypting appended records and decrypting read records with AES-GCM.
+// Records are bound to their position, raw frames are read with ReadAt.
+type cryptFiler struct {
+	Filer
+	keyID string
+	aead  cipher.AEAD
+	// position of the first record, after segment header
+	start uint64
+}
+
+// cipherFiler returns filer f decrypting records if it starts with a segment header.
+// With create set, an empty filer gets a header of the current key if encryption is enabled.
+func cipherFiler(f Filer, c Config, create bool) (Filer, error) {
+	kp := c.Encryption.KeyProvider
+	var header []byte
+	if _, err := f.Scan(0, func(_ uint64, p []byte) bool {
+		header = p
+		return false
+	}); err != nil {
+		log.Printf("cryptFiler.cipherFiler() - error reading first record, error: %v", err)
+		return nil, err
+	}
+	if header == nil && f.Size() > 0 && create && kp != nil {
+		// torn first record, filer holds no records
+		log.Printf("cryptFiler.cipherFiler() - truncating torn first record, filer: %s", f.Name())
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if f.Size() == 0 {
+		if !create || kp == nil {
+			return f, nil
+		}
+		id, key, err := kp.CurrentKey()
+		if err != nil {
+			log.Printf("cryptFiler.cipherFiler() - error getting current key, error: %v", err)
+			return nil, err
+		}
+		header := append([]byte(SEGMENT_HEADER_MAGIC), SEGMENT_HEADER_VERSION)
+		n, _, err := f.Append(append(header, id...))
+		if err != nil {
+			log.Printf("cryptFiler.cipherFiler() - error writing segment header, error: %v", err)
+			return nil, err
+		}
+		// header is synced, so that records are never written without it
+		if err = f.Sync(); err != nil {
+			return nil, err
+		}
+		return newCryptFiler(f, id, key, n)
+	}
+
+	if !bytes.HasPrefix(header, []byte(SEGMENT_HEADER_MAGIC)) {
+		// unencrypted filer
+		return f, nil
+	}
+	if len(header) < len(SEGMENT_HEADER_MAGIC)+1 || header[len(SEGMENT_HEADER_MAGIC)] != SEGMENT_HEADER_VERSION {
+		log.Printf("cryptFiler.cipherFiler() - unknown segment header, filer: %s", f.Name())
+		return nil, errors.NewAppError(ERROR_SEGMENT_HEADER, f.Name())
+	}
+	if kp == nil {
+		log.Printf("cryptFiler.cipherFiler() - encrypted filer without key provider, filer: %s", f.Name())
+		return nil, errors.NewAppError(ERROR_NO_KEY_PROVIDER, f.Name())
+	}
+	id := string(header[len(SEGMENT_HEADER_MAGIC)+1:])
+	key, err := kp.Key(id)
+	if err != nil {
+		log.Printf("cryptFiler.cipherFiler() - error getting key %s, error: %v", id, err)
+		return nil, err
+	}
+	return newCryptFiler(f, id, key, FRAME_HEADER_WIDTH+uint64(len(header)))
+}
+
+func newCryptFiler(f Filer, keyID string, key []byte, start uint64) (*cryptFiler, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Printf("cryptFiler.newCryptFiler() - error creating cipher, key: %s, error: %v", keyID, err)
+		return nil, errors.WrapError(err, ERROR_UNKNOWN_KEY, keyID)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Printf("cryptFiler.newCryptFiler() - error creating GCM, key: %s, error: %v", keyID, err)
+		return nil, errors.WrapError(err, ERROR_UNKNOWN_KEY, keyID)
+	}
+	return &cryptFiler{
+		Filer: f,
+		keyID: keyID,
+		aead:  aead,
+		start: start,
+	}, nil
+}
+
+// Append encrypts the record, as nonce followed by ciphertext, and appends it
+func (c *cryptFiler) Append(record []byte) (n uint64, pos uint64, err error) {
+	// single writer, new record position is filer size
+	pos = c.Filer.Size()
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(record)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Printf("cryptFiler.Append() - error generating nonce, error: %v", err)
+		return 0, 0, errors.WrapError(err, ERROR_ENCRYPTING_RECORD, c.Name())
+	}
+	return c.Filer.Append(c.aead.Seal(nonce, nonce, record, positionData(pos)))
+}
+
+func (c *cryptFiler) Read(pos uint64) ([]byte, error) {
+	p, err := c.Filer.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(pos, p)
+}
+
+// Scan walks decrypted records from pos, skipping segment header.
+// A record failing authentication ends the scan with an AuthenticationError.
+func (c *cryptFiler) Scan(pos uint64, fn func(pos uint64, record []byte) bool) (uint64, error) {
+	if pos < c.start {
+		pos = c.start
+	}
+	var oerr error
+	end, err := c.Filer.Scan(pos, func(pos uint64, p []byte) bool {
+		var record []byte
+		if record, oerr = c.open(pos, p); oerr != nil {
+			return false
+		}
+		return fn(pos, record)
+	})
+	if err == nil {
+		err = oerr
+	}
+	return end, err
+}
+
+// open decrypts and authenticates the record appended at pos
+func (c *cryptFiler) open(pos uint64, p []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	if len(p) < ns+c.aead.Overhead() {
+		log.Printf("cryptFiler.open() - short encrypted record, position: %d", pos)
+		return nil, &AuthenticationError{Name: c.Name(), Pos: pos}
+	}
+	record, err := c.aead.Open(nil, p[:ns], p[ns:], positionData(pos))
+	if err != nil {
+		log.Printf("cryptFiler.open() - error authenticating record, position: %d, key: %s", pos, c.keyID)
+		return nil, &AuthenticationError{Name: c.Name(), Pos: pos}
+	}
+	return record, nil
+}
+
+// positionData returns additional authenticated data binding a record to its position
+func positionData(pos uint64) []byte {
+	b := make([]byte, 8)
+	ENCODING.PutUint64(b, pos)
+	return b
+}
+
+// rawFiler returns the filer underneath an encrypting filer
+func rawFiler(f Filer) Filer {
+	if c, ok := f.(*cryptFiler); ok {
+		return c.Filer
+	}
+	return f
+}
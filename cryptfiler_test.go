@@ -0,0 +1,148 @@
+package recorder
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var TEST_KEYS = map[string][]byte{
+	"key-1": bytes.Repeat([]byte{1}, 32),
+	"key-2": bytes.Repeat([]byte{2}, 16),
+}
+
+func TestCryptFilerAppendRead(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "crypt-append-read-test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Encryption.KeyProvider = NewKeyRing("key-1", TEST_KEYS)
+
+	fi, err := os.Create(fPath)
+	require.NoError(t, err)
+	ff, err := newFiler(fi)
+	require.NoError(t, err)
+	f, err := cipherFiler(ff, c, true)
+	require.NoError(t, err)
+
+	positions := []uint64{}
+	for _, v := range TEST_RECORDS {
+		_, pos, err := f.Append(v)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	for i, pos := range positions {
+		b, err := f.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, TEST_RECORDS[i], b)
+	}
+	err = f.Close()
+	require.NoError(t, err)
+
+	// records are encrypted on disk
+	raw, err := os.ReadFile(fPath)
+	require.NoError(t, err)
+	for _, v := range TEST_RECORDS {
+		require.False(t, bytes.Contains(raw, v))
+	}
+
+	// reopened read only, with rotated keys
+	c.Encryption.KeyProvider = NewKeyRing("key-2", TEST_KEYS)
+	rf, err := openReadFiler(NewOSFS(), fPath)
+	require.NoError(t, err)
+	f, err = cipherFiler(rf, c, false)
+	require.NoError(t, err)
+	require.Equal(t, "key-1", f.(*cryptFiler).keyID)
+	var scanned int
+	end, err := f.Scan(0, func(pos uint64, record []byte) bool {
+		require.Equal(t, positions[scanned], pos)
+		require.Equal(t, TEST_RECORDS[scanned], record)
+		scanned++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(TEST_RECORDS), scanned)
+	require.Equal(t, f.Size(), end)
+	err = f.Close()
+	require.NoError(t, err)
+
+	// encrypted filer isn't read without its key
+	rf, err = openReadFiler(NewOSFS(), fPath)
+	require.NoError(t, err)
+	_, err = cipherFiler(rf, Config{}, false)
+	require.Error(t, err)
+	c.Encryption.KeyProvider = NewKeyRing("key-2", map[string][]byte{"key-2": TEST_KEYS["key-2"]})
+	_, err = cipherFiler(rf, c, false)
+	require.Error(t, err)
+	err = rf.Close()
+	require.NoError(t, err)
+}
+
+func TestCryptFilerTampered(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "crypt-tampered-test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Encryption.KeyProvider = NewKeyRing("key-1", TEST_KEYS)
+
+	fi, err := os.Create(fPath)
+	require.NoError(t, err)
+	ff, err := newFiler(fi)
+	require.NoError(t, err)
+	f, err := cipherFiler(ff, c, true)
+	require.NoError(t, err)
+	_, pos0, err := f.Append(TEST_RECORD)
+	require.NoError(t, err)
+	_, pos1, err := f.Append(TEST_RECORD)
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+
+	raw, err := os.ReadFile(fPath)
+	require.NoError(t, err)
+	frame0 := append([]byte{}, raw[pos0:pos1]...)
+
+	// flipped ciphertext bit, with a valid frame checksum
+	tampered := append([]byte{}, frame0...)
+	tampered[len(tampered)-1] ^= 1
+	ENCODING.PutUint32(tampered[RECORD_LENGTH_WIDTH:], crc32.Checksum(tampered[FRAME_HEADER_WIDTH:], CHECKSUM_TABLE))
+	copy(raw[pos0:], tampered)
+	// swapped records
+	copy(raw[pos1:], frame0)
+	err = os.WriteFile(fPath, raw, 0644)
+	require.NoError(t, err)
+
+	rf, err := openReadFiler(NewOSFS(), fPath)
+	require.NoError(t, err)
+	f, err = cipherFiler(rf, c, false)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, pos := range []uint64{pos0, pos1} {
+		_, err = f.Read(pos)
+		require.Error(t, err)
+		aerr, ok := err.(*AuthenticationError)
+		require.True(t, ok)
+		require.Equal(t, pos, aerr.Pos)
+	}
+	end, err := f.Scan(0, func(pos uint64, record []byte) bool {
+		return true
+	})
+	require.Equal(t, pos0, end)
+	_, ok := err.(*AuthenticationError)
+	require.True(t, ok)
+}
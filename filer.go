@@ -3,20 +3,35 @@ package recorder
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
-	"os"
 	"sync"
 
 	"github.com/comfforts/errors"
 )
 
 var (
-	ENCODING = binary.BigEndian
+	ENCODING       = binary.BigEndian
+	CHECKSUM_TABLE = crc32.MakeTable(crc32.Castagnoli)
 )
 
 // https://go.dev/ref/spec#Size_and_alignment_guarantees
 const (
 	RECORD_LENGTH_WIDTH = 8
+	CHECKSUM_WIDTH      = 4
+	FRAME_HEADER_WIDTH  = RECORD_LENGTH_WIDTH + CHECKSUM_WIDTH
+)
+
+// frame versions, carried in the high byte of the record length.
+// Legacy frames are a bare record length followed by the record,
+// checksum frames add a CRC32-C of the record after the record length.
+const (
+	FRAME_VERSION_LEGACY   uint8 = 0
+	FRAME_VERSION_CHECKSUM uint8 = 1
+	FRAME_VERSION_SHIFT          = 56
+	RECORD_LENGTH_MASK           = uint64(1)<<FRAME_VERSION_SHIFT - 1
 )
 
 const (
@@ -26,26 +41,44 @@ const (
 	ERROR_BUFFER         string = "error flushing buffer for %s"
 	ERROR_REC_LEN_READ   string = "error reading record length in %s"
 	ERROR_REC_READ       string = "error reading record in %s"
+	ERROR_TRUNCATE       string = "error truncating %s"
+	ERROR_SYNC           string = "error syncing %s"
+	ERROR_CORRUPT_RECORD string = "corrupt record in %s at position %d"
 )
 
+// CorruptRecordError is returned for records failing checksum verification
+type CorruptRecordError struct {
+	Name string
+	Pos  uint64
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf(ERROR_CORRUPT_RECORD, e.Name, e.Pos)
+}
+
 type Filer interface {
 	Append(record []byte) (n uint64, pos uint64, err error)
 	Read(pos uint64) ([]byte, error)
 	ReadAt(p []byte, off int64) (int, error)
+	Scan(pos uint64, fn func(pos uint64, record []byte) bool) (end uint64, err error)
+	Truncate(size int64) error
+	Size() uint64
+	Flush() error
+	Sync() error
 	Close() error
 	Name() string
 }
 
 // filer: os.File Wrapper for buffered and indexed read/write
 type filer struct {
-	*os.File
+	File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
 }
 
-func newFiler(f *os.File) (*filer, error) {
-	fs, err := os.Stat(f.Name())
+func newFiler(f File) (*filer, error) {
+	fs, err := f.Stat()
 	if err != nil {
 		log.Printf("filer.newFiler() - error getting filer file stats, error: %v", err)
 		return nil, errors.WrapError(err, ERROR_NO_FILE, f.Name())
@@ -65,8 +98,11 @@ func (f *filer) Append(record []byte) (n uint64, pos uint64, err error) {
 	// new record position
 	pos = f.size
 
-	// append record length
-	if err := binary.Write(f.buf, ENCODING, uint64(len(record))); err != nil {
+	// append versioned record length and record checksum
+	header := make([]byte, FRAME_HEADER_WIDTH)
+	ENCODING.PutUint64(header, uint64(FRAME_VERSION_CHECKSUM)<<FRAME_VERSION_SHIFT|uint64(len(record)))
+	ENCODING.PutUint32(header[RECORD_LENGTH_WIDTH:], crc32.Checksum(record, CHECKSUM_TABLE))
+	if _, err := f.buf.Write(header); err != nil {
 		log.Printf("filer.Append() - error appending record, error: %v", err)
 		return 0, 0, errors.WrapError(err, ERROR_REC_LEN_APPEND, f.Name())
 	}
@@ -79,7 +115,7 @@ func (f *filer) Append(record []byte) (n uint64, pos uint64, err error) {
 	}
 
 	// final record size
-	w += RECORD_LENGTH_WIDTH
+	w += FRAME_HEADER_WIDTH
 
 	// update file size
 	f.size += uint64(w)
@@ -97,20 +133,54 @@ func (f *filer) Read(pos uint64) ([]byte, error) {
 		return nil, errors.WrapError(err, ERROR_BUFFER, f.Name())
 	}
 
+	b, _, err := readFrame(f.File, f.Name(), pos)
+	return b, err
+}
+
+// readFrame reads and verifies the record framed at pos of named file r,
+// returning the record and frame width
+func readFrame(r io.ReaderAt, name string, pos uint64) ([]byte, uint64, error) {
 	// read record length
 	size := make([]byte, RECORD_LENGTH_WIDTH)
-	if _, err := f.File.ReadAt(size, int64(pos)); err != nil {
-		log.Printf("filer.Read() - error reading record length, error: %v", err)
-		return nil, errors.WrapError(err, ERROR_REC_LEN_READ, f.Name())
+	if _, err := r.ReadAt(size, int64(pos)); err != nil {
+		log.Printf("filer.readFrame() - error reading record length, error: %v", err)
+		return nil, 0, errors.WrapError(err, ERROR_REC_LEN_READ, name)
 	}
+	version, header, n := decodeRecordLength(size)
+	if header == 0 {
+		log.Printf("filer.readFrame() - unknown frame version, position: %d, version: %d", pos, version)
+		return nil, 0, &CorruptRecordError{Name: name, Pos: pos}
+	}
+
+	// read record checksum and record
+	b := make([]byte, header-RECORD_LENGTH_WIDTH+n)
+	if _, err := r.ReadAt(b, int64(pos+RECORD_LENGTH_WIDTH)); err != nil {
+		log.Printf("filer.readFrame() - error reading record, error: %v", err)
+		return nil, 0, errors.WrapError(err, ERROR_REC_READ, name)
+	}
+	if version == FRAME_VERSION_CHECKSUM {
+		sum, record := ENCODING.Uint32(b[:CHECKSUM_WIDTH]), b[CHECKSUM_WIDTH:]
+		if crc32.Checksum(record, CHECKSUM_TABLE) != sum {
+			log.Printf("filer.readFrame() - record checksum mismatch, position: %d", pos)
+			return nil, 0, &CorruptRecordError{Name: name, Pos: pos}
+		}
+		b = record
+	}
+	return b, header + n, nil
+}
 
-	// read record
-	b := make([]byte, ENCODING.Uint64(size))
-	if _, err := f.File.ReadAt(b, int64(pos+RECORD_LENGTH_WIDTH)); err != nil {
-		log.Printf("filer.Read() - error reading record, error: %v", err)
-		return nil, errors.WrapError(err, ERROR_REC_READ, f.Name())
+// decodeRecordLength splits a record length into frame version, frame header width
+// and record length. Header width is zero for unknown frame versions.
+func decodeRecordLength(b []byte) (version uint8, header uint64, n uint64) {
+	l := ENCODING.Uint64(b)
+	version, n = uint8(l>>FRAME_VERSION_SHIFT), l&RECORD_LENGTH_MASK
+	switch version {
+	case FRAME_VERSION_LEGACY:
+		header = RECORD_LENGTH_WIDTH
+	case FRAME_VERSION_CHECKSUM:
+		header = FRAME_HEADER_WIDTH
 	}
-	return b, nil
+	return version, header, n
 }
 
 func (f *filer) ReadAt(p []byte, off int64) (int, error) {
@@ -124,6 +194,112 @@ func (f *filer) ReadAt(p []byte, off int64) (int, error) {
 	return f.File.ReadAt(p, off)
 }
 
+// Scan walks complete records starting at pos, calling fn with each record's
+// position until fn returns false, and returns the end position of the last
+// accepted record. A torn last record ends the scan, a corrupt record
+// before it fails the scan with a CorruptRecordError.
+func (f *filer) Scan(pos uint64, fn func(pos uint64, record []byte) bool) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("filer.Scan() - error flushing buffer, error: %v", err)
+		return 0, errors.WrapError(err, ERROR_BUFFER, f.Name())
+	}
+	return scanFrames(f.File, f.Name(), f.size, pos, fn)
+}
+
+// scanFrames walks complete records of named file r with size bytes, starting at pos
+func scanFrames(r io.ReaderAt, name string, fileSize, pos uint64, fn func(pos uint64, record []byte) bool) (uint64, error) {
+	size := make([]byte, RECORD_LENGTH_WIDTH)
+	for pos+RECORD_LENGTH_WIDTH <= fileSize {
+		if _, err := r.ReadAt(size, int64(pos)); err != nil {
+			log.Printf("filer.Scan() - error reading record length, error: %v", err)
+			return pos, errors.WrapError(err, ERROR_REC_LEN_READ, name)
+		}
+		_, header, n := decodeRecordLength(size)
+		if header == 0 {
+			log.Printf("filer.Scan() - unknown frame version, position: %d", pos)
+			return pos, &CorruptRecordError{Name: name, Pos: pos}
+		}
+		if header > fileSize-pos || n > fileSize-pos-header {
+			log.Printf("filer.Scan() - torn record, position: %d, record length: %d, file size: %d", pos, n, fileSize)
+			break
+		}
+		b, w, err := readFrame(r, name, pos)
+		if err != nil {
+			// only the last record can be torn, a corrupt record before it is reported
+			if _, ok := err.(*CorruptRecordError); ok && pos+header+n == fileSize {
+				log.Printf("filer.Scan() - torn record, position: %d, record length: %d, file size: %d", pos, n, fileSize)
+				break
+			}
+			return pos, err
+		}
+		if !fn(pos, b) {
+			break
+		}
+		pos += w
+	}
+	return pos, nil
+}
+
+// Truncate discards file contents from size onwards. After a failed write
+// buffered records are discarded, if they're all beyond size.
+func (f *filer) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("filer.Truncate() - error flushing buffer, error: %v", err)
+		// failed buffer keeps failing until reset
+		f.buf.Reset(f.File)
+		fi, serr := f.File.Stat()
+		if serr != nil || size > fi.Size() {
+			return errors.WrapError(err, ERROR_BUFFER, f.Name())
+		}
+	}
+	if err := f.File.Truncate(size); err != nil {
+		log.Printf("filer.Truncate() - error truncating file, error: %v", err)
+		return errors.WrapError(err, ERROR_TRUNCATE, f.Name())
+	}
+	f.size = uint64(size)
+	return nil
+}
+
+func (f *filer) Size() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// Flush hands buffered records over to the OS
+func (f *filer) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("filer.Flush() - error flushing buffer, error: %v", err)
+		return errors.WrapError(err, ERROR_BUFFER, f.Name())
+	}
+	return nil
+}
+
+// Sync commits appended records to stable storage
+func (f *filer) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("filer.Sync() - error flushing buffer, error: %v", err)
+		return errors.WrapError(err, ERROR_BUFFER, f.Name())
+	}
+	if err := f.File.Sync(); err != nil {
+		log.Printf("filer.Sync() - error syncing file, error: %v", err)
+		return errors.WrapError(err, ERROR_SYNC, f.Name())
+	}
+	return nil
+}
+
 func (f *filer) Close() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -12,8 +12,8 @@ const TEST_DATA_DIR = "data"
 
 var (
 	TEST_RECORD = []byte("hello world")
-	// record width is record length + max size of record length header
-	TEST_RECORD_WIDTH = uint64(len(TEST_RECORD)) + RECORD_LENGTH_WIDTH
+	// record width is record length + frame header size
+	TEST_RECORD_WIDTH = uint64(len(TEST_RECORD)) + FRAME_HEADER_WIDTH
 	TEST_RECORDS      = [][]byte{
 		[]byte("hello world"),
 		[]byte("hello ninpoop"),
@@ -62,7 +62,7 @@ func TestWriteAndRead(t *testing.T) {
 	positions := []uint64{}
 	bytesWritten := []uint64{}
 	for _, v := range TEST_RECORDS {
-		rec_width := uint64(len(v)) + RECORD_LENGTH_WIDTH
+		rec_width := uint64(len(v)) + FRAME_HEADER_WIDTH
 		n, pos, err := filer.Append(v)
 		require.NoError(t, err)
 		positions = append(positions, pos)
@@ -74,7 +74,7 @@ func TestWriteAndRead(t *testing.T) {
 		b, err := filer.Read(pos)
 		require.NoError(t, err)
 		require.Equal(t, string(TEST_RECORDS[i]), string(b))
-		require.Equal(t, bytesWritten[i], uint64(RECORD_LENGTH_WIDTH+len(b)))
+		require.Equal(t, bytesWritten[i], uint64(FRAME_HEADER_WIDTH+len(b)))
 	}
 
 }
@@ -150,13 +150,13 @@ func testRead(t *testing.T, filer *filer) {
 func testReadAt(t *testing.T, filer *filer) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, RECORD_LENGTH_WIDTH)
+		b := make([]byte, FRAME_HEADER_WIDTH)
 		n, err := filer.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, RECORD_LENGTH_WIDTH, n)
+		require.Equal(t, FRAME_HEADER_WIDTH, n)
 		off += int64(n)
 
-		size := ENCODING.Uint64(b)
+		size := ENCODING.Uint64(b) & RECORD_LENGTH_MASK
 		b = make([]byte, size)
 		n, err = filer.ReadAt(b, off)
 		require.NoError(t, err)
@@ -195,3 +195,166 @@ func createDirectory(path string) error {
 	}
 	return nil
 }
+
+func TestFilerScanTruncate(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "scan-truncate-test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.OpenFile(fPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+
+	filer, err := newFiler(f)
+	require.NoError(t, err)
+
+	positions := []uint64{}
+	for _, v := range TEST_RECORDS {
+		_, pos, err := filer.Append(v)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	size := filer.Size()
+	err = filer.Flush()
+	require.NoError(t, err)
+
+	// torn trailing record
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 1, 0, 1})
+	require.NoError(t, err)
+	filer, err = newFiler(f)
+	require.NoError(t, err)
+
+	scanned := [][]byte{}
+	end, err := filer.Scan(0, func(pos uint64, record []byte) bool {
+		require.Equal(t, positions[len(scanned)], pos)
+		scanned = append(scanned, record)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, size, end)
+	require.Equal(t, TEST_RECORDS, scanned)
+
+	end, err = filer.Scan(0, func(pos uint64, record []byte) bool {
+		return pos < positions[2]
+	})
+	require.NoError(t, err)
+	require.Equal(t, positions[2], end)
+
+	err = filer.Truncate(int64(end))
+	require.NoError(t, err)
+	require.Equal(t, positions[2], filer.Size())
+
+	_, pos, err := filer.Append(TEST_RECORD)
+	require.NoError(t, err)
+	require.Equal(t, positions[2], pos)
+	b, err := filer.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, TEST_RECORD, b)
+
+	err = filer.Close()
+	require.NoError(t, err)
+}
+
+func TestFilerLegacyFrames(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "legacy-frames-test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	// unversioned frame, bare record length followed by record
+	legacy := make([]byte, RECORD_LENGTH_WIDTH)
+	ENCODING.PutUint64(legacy, uint64(len(TEST_RECORD)))
+	legacy = append(legacy, TEST_RECORD...)
+	err = os.WriteFile(fPath, legacy, 0644)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(fPath, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	filer, err := newFiler(f)
+	require.NoError(t, err)
+
+	b, err := filer.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, TEST_RECORD, b)
+
+	n, pos, err := filer.Append(TEST_RECORDS[1])
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(legacy)), pos)
+
+	scanned := [][]byte{}
+	end, err := filer.Scan(0, func(pos uint64, record []byte) bool {
+		scanned = append(scanned, record)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, pos+n, end)
+	require.Equal(t, [][]byte{TEST_RECORD, TEST_RECORDS[1]}, scanned)
+
+	err = filer.Close()
+	require.NoError(t, err)
+}
+
+func TestFilerCorruptRecord(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "corrupt-record-test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+	filer, err := newFiler(f)
+	require.NoError(t, err)
+
+	_, pos, err := filer.Append(TEST_RECORD)
+	require.NoError(t, err)
+	_, last, err := filer.Append(TEST_RECORDS[1])
+	require.NoError(t, err)
+	err = filer.Flush()
+	require.NoError(t, err)
+
+	// flip a record bit
+	_, err = f.WriteAt([]byte{'j'}, int64(pos+FRAME_HEADER_WIDTH))
+	require.NoError(t, err)
+
+	_, err = filer.Read(pos)
+	require.Error(t, err)
+	cerr, ok := err.(*CorruptRecordError)
+	require.True(t, ok)
+	require.Equal(t, fPath, cerr.Name)
+	require.Equal(t, pos, cerr.Pos)
+
+	// corrupt record followed by records isn't torn
+	end, err := filer.Scan(0, func(pos uint64, record []byte) bool {
+		return true
+	})
+	require.Error(t, err)
+	_, ok = err.(*CorruptRecordError)
+	require.True(t, ok)
+	require.Equal(t, pos, end)
+
+	// corrupt last record is torn, ending the scan
+	end, err = filer.Scan(last, func(pos uint64, record []byte) bool {
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, filer.Size(), end)
+	_, err = f.WriteAt([]byte{'j'}, int64(last+FRAME_HEADER_WIDTH))
+	require.NoError(t, err)
+	end, err = filer.Scan(last, func(pos uint64, record []byte) bool {
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, last, end)
+
+	err = filer.Close()
+	require.NoError(t, err)
+}
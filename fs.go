@@ -0,0 +1,277 @@
+package recorder
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/comfforts/errors"
+)
+
+// FS opens and manages segment files, so that the recorder can run
+// on disk, in memory or with injected faults
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	// SyncDir makes creations, renames and removals of files in directory name durable
+	SyncDir(name string) error
+	// Lock locks named lock file, shared or exclusive, without waiting.
+	// ErrLocked is returned if the lock is held in a conflicting mode.
+	// Shared locks don't create the lock file.
+	Lock(name string, shared bool) (io.Closer, error)
+}
+
+// File is an open segment file
+type File interface {
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// osFS: FS of operating system files
+type osFS struct{}
+
+// NewOSFS returns the FS of operating system files
+func NewOSFS() FS {
+	return osFS{}
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoids returning a typed nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) SyncDir(name string) error {
+	return syncDir(name)
+}
+
+// Lock locks the lock file with flock, released when the returned file is closed.
+// Only the exclusive lock creates the lock file, shared locks open it read only.
+func (osFS) Lock(name string, shared bool) (io.Closer, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if shared {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, 0644)
+	if shared && os.IsNotExist(err) {
+		// writers create the lock file, a log never opened by a writer has none to share
+		log.Printf("osFS.Lock() - no lock file, shared lock isn't held, lock file: %s", name)
+		return noLock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(f, shared); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// noLock: shared lock of a missing lock file, nothing to release
+type noLock struct{}
+
+func (noLock) Close() error {
+	return nil
+}
+
+// copyFile returns an in memory copy of named file, empty if the file doesn't exist.
+// Read only segments rebuild and resize copies, leaving the writer's files untouched.
+func copyFile(fsys FS, name string) (File, error) {
+	var data []byte
+	src, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err == nil {
+		defer src.Close()
+		fi, err := src.Stat()
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, fi.Size())
+		n, err := src.ReadAt(data, 0)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = data[:n]
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cp, err := NewMemFS().OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = cp.WriteAt(data, 0); err != nil {
+		cp.Close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+const (
+	ERROR_FAULT_INJECTED string = "injected fault"
+	ERROR_LOCKED         string = "lock held"
+)
+
+var (
+	ErrFaultInjected = errors.NewAppError(ERROR_FAULT_INJECTED)
+	ErrLocked        = errors.NewAppError(ERROR_LOCKED)
+)
+
+// FaultOp specifies the file operation a fault is injected into
+type FaultOp int
+
+const (
+	// FAULT_WRITE fails Write and WriteAt
+	FAULT_WRITE FaultOp = iota
+	// FAULT_SYNC fails Sync
+	FAULT_SYNC
+)
+
+// Fault fails matching file operations, from the After+1th matching operation
+// until faults are cleared. A write fault with Short bytes writes Short bytes
+// before failing, ENOSPC is injected with Err syscall.ENOSPC.
+type Fault struct {
+	Op FaultOp
+	// Path matches file names ending with Path, empty matches every file
+	Path string
+	// After specifies the number of matching operations passed before failing
+	After int
+	// Short specifies the bytes written by a failing write
+	Short int
+	// Err specifies the returned error, defaults to io.ErrShortWrite
+	// for writes and ErrFaultInjected for syncs
+	Err error
+}
+
+// faultFS: FS injecting faults into files of an underlying FS
+type faultFS struct {
+	FS
+	mu     sync.Mutex
+	faults []*fault
+}
+
+type fault struct {
+	Fault
+	seen int
+}
+
+// NewFaultFS returns an FS injecting faults into files of fsys
+func NewFaultFS(fsys FS) *faultFS {
+	return &faultFS{FS: fsys}
+}
+
+// Inject adds a fault to files opened before or after
+func (f *faultFS) Inject(ft Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ft.Err == nil && ft.Op == FAULT_WRITE {
+		ft.Err = io.ErrShortWrite
+	} else if ft.Err == nil {
+		ft.Err = ErrFaultInjected
+	}
+	f.faults = append(f.faults, &fault{Fault: ft})
+}
+
+// Clear removes injected faults
+func (f *faultFS) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// match returns the fault failing operation op of named file, nil if it doesn't fail
+func (f *faultFS) match(op FaultOp, name string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ft := range f.faults {
+		if ft.Op != op || !strings.HasSuffix(name, ft.Path) {
+			continue
+		}
+		if ft.seen++; ft.seen > ft.After {
+			return &ft.Fault
+		}
+	}
+	return nil
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fsys: f}, nil
+}
+
+// faultFile: File failing operations matching faults of its FS
+type faultFile struct {
+	File
+	fsys *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if ft := f.fsys.match(FAULT_WRITE, f.Name()); ft != nil {
+		return f.short(ft, func(b []byte) (int, error) { return f.File.Write(b) }, p)
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if ft := f.fsys.match(FAULT_WRITE, f.Name()); ft != nil {
+		return f.short(ft, func(b []byte) (int, error) { return f.File.WriteAt(b, off) }, p)
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// short writes fault's short bytes of p with write, failing with fault's error
+func (f *faultFile) short(ft *Fault, write func(b []byte) (int, error), p []byte) (int, error) {
+	var n int
+	if ft.Short > 0 {
+		if ft.Short < len(p) {
+			p = p[:ft.Short]
+		}
+		n, _ = write(p)
+	}
+	return n, ft.Err
+}
+
+func (f *faultFile) Sync() error {
+	if ft := f.fsys.match(FAULT_SYNC, f.Name()); ft != nil {
+		return ft.Err
+	}
+	return f.File.Sync()
+}
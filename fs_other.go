@@ -0,0 +1,19 @@
+//go:build !unix
+
+package recorder
+
+import (
+	"log"
+	"os"
+)
+
+// flock doesn't lock on platforms without flock, the lock file is only created
+func flock(f *os.File, shared bool) error {
+	log.Printf("fs.flock() - file locking isn't supported on this platform, lock file: %s", f.Name())
+	return nil
+}
+
+// syncDir doesn't sync on platforms where directories can't be synced
+func syncDir(name string) error {
+	return nil
+}
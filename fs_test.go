@@ -0,0 +1,193 @@
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+
+	_, err := fsys.OpenFile("mem/0.filer", os.O_RDWR, 0644)
+	require.True(t, os.IsNotExist(err))
+
+	f, err := fsys.OpenFile("mem/0.filer", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("world"))
+	require.NoError(t, err)
+
+	b := make([]byte, 5)
+	_, err = f.ReadAt(b, 6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), b)
+	n, err := f.ReadAt(b, 8)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 3, n)
+
+	_, err = f.WriteAt([]byte("W"), 6)
+	require.NoError(t, err)
+	err = f.Truncate(7)
+	require.NoError(t, err)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(7), fi.Size())
+	require.Equal(t, "0.filer", fi.Name())
+	err = f.Sync()
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+	_, err = f.Write([]byte("closed"))
+	require.Equal(t, os.ErrClosed, err)
+
+	// read only files aren't written
+	f, err = fsys.OpenFile("mem/0.filer", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = f.ReadAt(b[:1], 6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("W"), b[:1])
+	_, err = f.Write([]byte("read only"))
+	require.Error(t, err)
+
+	f, err = fsys.OpenFile("mem/0.index", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("index"))
+	require.NoError(t, err)
+	_, err = fsys.OpenFile("mem/sub/1.filer", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+
+	entries, err := fsys.ReadDir("mem/")
+	require.NoError(t, err)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"0.filer", "0.index"}, names)
+
+	err = fsys.Rename("mem/0.index", "mem/1.index")
+	require.NoError(t, err)
+	fi, err = fsys.Stat("mem/1.index")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), fi.Size())
+	_, err = fsys.Stat("mem/0.index")
+	require.True(t, os.IsNotExist(err))
+
+	err = fsys.Remove("mem/1.index")
+	require.NoError(t, err)
+	err = fsys.Remove("mem/1.index")
+	require.True(t, os.IsNotExist(err))
+
+	err = fsys.RemoveAll("mem")
+	require.NoError(t, err)
+	_, err = fsys.Stat("mem/sub/1.filer")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMemFSLock(t *testing.T) {
+	fsys := NewMemFS()
+
+	l, err := fsys.Lock("mem/LOCK", false)
+	require.NoError(t, err)
+	_, err = fsys.Lock("mem/LOCK", true)
+	require.Equal(t, ErrLocked, err)
+	_, err = fsys.Lock("mem/LOCK", false)
+	require.Equal(t, ErrLocked, err)
+	err = l.Close()
+	require.NoError(t, err)
+	err = l.Close()
+	require.Equal(t, os.ErrClosed, err)
+
+	s1, err := fsys.Lock("mem/LOCK", true)
+	require.NoError(t, err)
+	s2, err := fsys.Lock("mem/LOCK", true)
+	require.NoError(t, err)
+	err = s1.Close()
+	require.NoError(t, err)
+	_, err = fsys.Lock("mem/LOCK", false)
+	require.Equal(t, ErrLocked, err)
+	err = s2.Close()
+	require.NoError(t, err)
+	l, err = fsys.Lock("mem/LOCK", false)
+	require.NoError(t, err)
+	err = l.Close()
+	require.NoError(t, err)
+}
+
+func TestOSFSLock(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fsys := NewOSFS()
+	name := path.Join(dir, LOCK_FILE)
+
+	// shared lock doesn't create the lock file
+	s, err := fsys.Lock(name, true)
+	require.NoError(t, err)
+	err = s.Close()
+	require.NoError(t, err)
+	_, err = fsys.Stat(name)
+	require.True(t, os.IsNotExist(err))
+
+	// exclusive lock creates it, shared locks open it read only
+	l, err := fsys.Lock(name, false)
+	require.NoError(t, err)
+	_, err = fsys.Stat(name)
+	require.NoError(t, err)
+	err = l.Close()
+	require.NoError(t, err)
+	err = os.Chmod(name, 0444)
+	require.NoError(t, err)
+	s, err = fsys.Lock(name, true)
+	require.NoError(t, err)
+	err = s.Close()
+	require.NoError(t, err)
+}
+
+func TestFaultFS(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+
+	f, err := fsys.OpenFile("fault/0.filer", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	idx, err := fsys.OpenFile("fault/0.index", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+
+	// short write after a successful write
+	fsys.Inject(Fault{Op: FAULT_WRITE, Path: FILER_EXT, After: 1, Short: 3})
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	n, err := f.Write([]byte("world"))
+	require.Equal(t, io.ErrShortWrite, err)
+	require.Equal(t, 3, n)
+	// other files aren't faulted
+	_, err = idx.WriteAt([]byte("index"), 0)
+	require.NoError(t, err)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(8), fi.Size())
+
+	fsys.Clear()
+	fsys.Inject(Fault{Op: FAULT_WRITE, Err: syscall.ENOSPC})
+	_, err = idx.WriteAt([]byte("index"), 5)
+	require.Equal(t, syscall.ENOSPC, err)
+	_, err = f.Write([]byte("world"))
+	require.Equal(t, syscall.ENOSPC, err)
+
+	fsys.Clear()
+	fsys.Inject(Fault{Op: FAULT_SYNC})
+	err = f.Sync()
+	require.Equal(t, ErrFaultInjected, err)
+	_, err = f.Write([]byte("world"))
+	require.NoError(t, err)
+
+	fsys.Clear()
+	err = f.Sync()
+	require.NoError(t, err)
+}
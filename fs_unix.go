@@ -0,0 +1,36 @@
+//go:build unix
+
+package recorder
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock locks file f without waiting, ErrLocked if it's locked in a conflicting mode
+func flock(f *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+		return err
+	}
+	return nil
+}
+
+// syncDir syncs directory name, making its entries durable
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
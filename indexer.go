@@ -1,10 +1,11 @@
 package recorder
 
 import (
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
-	"os"
+	"sort"
 	"sync"
 
 	"github.com/comfforts/errors"
@@ -19,6 +20,9 @@ var (
 const (
 	ERROR_DECODING_INDEX_FILE string = "error decoding file %s"
 	ERROR_ENCODING_INDEX_FILE string = "error encoding file %s"
+	ERROR_WRITING_INDEX_ENTRY string = "error writing index entry in %s"
+	ERROR_SYNCING_INDEX_FILE  string = "error syncing index file %s"
+	ERROR_TRUNCATING_INDEX    string = "error truncating index file %s"
 	ERROR_DUPLICATE_OFFSET    string = "error offset already exists"
 	ERROR_GETTING_RECORD_POS  string = "error fetching record position"
 )
@@ -33,23 +37,46 @@ type Mapper = map[uint32]uint64
 type Indexer interface {
 	Write(off uint32, pos uint64) error
 	Read(inOff int64) (outOff uint32, pos uint64, err error)
+	Truncate(off uint32) error
+	Sync() error
 	Close() error
 	Name() string
 	Size() uint64
 }
 
+// indexer: in memory offset to position map,
+// persisted as append only fixed width (offset, position) entries.
+// Offsets increase across entries, with gaps in compacted segments.
 type indexer struct {
-	file   *os.File
-	size   uint64
-	mapper Mapper
-	mu     sync.Mutex
+	file    File
+	size    uint64
+	mapper  Mapper
+	offsets []uint32
+	mu      sync.Mutex
 }
 
-func newIndexer(f *os.File, c Config) (*indexer, error) {
+// openIndexer opens the index file in configured index format
+func openIndexer(f File, c Config) (Indexer, error) {
+	var idx Indexer
+	var err error
+	// read only segments index in memory, without mapping
+	if c.Segment.IndexFormat == INDEX_MMAP && !c.ReadOnly {
+		idx, err = newMmapIndexer(f, c)
+	} else {
+		idx, err = newIndexer(f, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func newIndexer(f File, c Config) (*indexer, error) {
 	idx := &indexer{
-		file: f,
+		file:   f,
+		mapper: Mapper{},
 	}
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		log.Printf("indexer.newIndexer() - error getting file stats, error: %v", err)
 		return nil, errors.WrapError(err, ERROR_NO_FILE, f.Name())
@@ -58,35 +85,108 @@ func newIndexer(f *os.File, c Config) (*indexer, error) {
 	log.Printf("indexer file size: %d", fi.Size())
 
 	if fi.Size() > 0 {
-		decoder := gob.NewDecoder(f)
-		err = decoder.Decode(&idx.mapper)
-		if err != nil {
-			log.Printf("indexer.newIndexer() - error decoding index file, error: %v", err)
-			return nil, errors.WrapError(err, ERROR_DECODING_INDEX_FILE, f.Name())
+		if err = idx.load(fi.Size()); err != nil {
+			log.Printf("indexer.newIndexer() - error loading index file, error: %v", err)
+			return nil, err
 		}
-		idx.size = uint64(len(idx.mapper) - 1)
-	} else {
-		idx.mapper = Mapper{}
 	}
 
 	return idx, nil
 }
 
+// load builds index state from index file entries.
+// A torn trailing entry is truncated, legacy gob encoded index files are migrated.
+func (i *indexer) load(fileSize int64) error {
+	b := make([]byte, fileSize)
+	if _, err := i.file.ReadAt(b, 0); err != nil && err != io.EOF {
+		log.Printf("indexer.load() - error reading index file, error: %v", err)
+		return errors.WrapError(err, ERROR_DECODING_INDEX_FILE, i.Name())
+	}
+
+	// entries begin with the high byte of relative offset 0,
+	// gob streams always begin with a non zero message length
+	if b[0] != 0 {
+		return i.migrate(b)
+	}
+
+	n := uint64(len(b)) / ENTRY_WIDTH
+	for j := uint64(0); j < n; j++ {
+		off, pos := decodeEntry(b[j*ENTRY_WIDTH:])
+		if j > 0 && off <= i.offsets[j-1] {
+			log.Printf("indexer.load() - error unexpected offset in index file, offset: %d, entry: %d", off, j)
+			return errors.NewAppError(ERROR_DECODING_INDEX_FILE, i.Name())
+		}
+		i.mapper[off] = pos
+		i.offsets = append(i.offsets, off)
+	}
+	i.size = n
+
+	if uint64(len(b)) > n*ENTRY_WIDTH {
+		log.Printf("indexer.load() - truncating torn index entry, file: %s, entries: %d", i.Name(), n)
+		if err := i.file.Truncate(int64(n * ENTRY_WIDTH)); err != nil {
+			return errors.WrapError(err, ERROR_DECODING_INDEX_FILE, i.Name())
+		}
+	}
+	return nil
+}
+
+// migrate decodes a gob encoded index and rewrites it as fixed width entries
+func (i *indexer) migrate(b []byte) error {
+	decoder := gob.NewDecoder(bytes.NewReader(b))
+	if err := decoder.Decode(&i.mapper); err != nil {
+		log.Printf("indexer.migrate() - error decoding index file, error: %v", err)
+		return errors.WrapError(err, ERROR_DECODING_INDEX_FILE, i.Name())
+	}
+	i.size = uint64(len(i.mapper))
+
+	offs := make([]uint32, 0, len(i.mapper))
+	for off := range i.mapper {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(a, b int) bool {
+		return offs[a] < offs[b]
+	})
+	i.offsets = offs
+
+	entries := make([]byte, 0, uint64(len(offs))*ENTRY_WIDTH)
+	for _, off := range offs {
+		entries = append(entries, encodeEntry(off, i.mapper[off])...)
+	}
+	if err := i.file.Truncate(0); err != nil {
+		log.Printf("indexer.migrate() - error truncating index file, error: %v", err)
+		return errors.WrapError(err, ERROR_ENCODING_INDEX_FILE, i.Name())
+	}
+	if _, err := i.file.WriteAt(entries, 0); err != nil {
+		log.Printf("indexer.migrate() - error writing index entries, error: %v", err)
+		return errors.WrapError(err, ERROR_ENCODING_INDEX_FILE, i.Name())
+	}
+	log.Printf("indexer.migrate() - migrated gob index file, file: %s, index size: %d", i.Name(), i.size)
+	return nil
+}
+
 func (i *indexer) Write(off uint32, pos uint64) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if off > uint32(i.size)+1 {
-		log.Printf("indexer.Write() - error offset greater than index size, returning io.EOF, offset: %d, index size: %d", off, i.size)
+	_, ok := i.mapper[off]
+	if ok {
+		return ErrDuplicateOffset
+	}
+
+	// offsets are appended in increasing order
+	if i.size > 0 && off < i.offsets[i.size-1] {
+		log.Printf("indexer.Write() - error offset less than last offset, returning io.EOF, offset: %d, last offset: %d", off, i.offsets[i.size-1])
 		// TOCHECK should return specific error, rather than io.EOF error?
 		return io.EOF
 	}
 
-	_, ok := i.mapper[off]
-	if ok {
-		return ErrDuplicateOffset
+	// persist entry before acknowledging it
+	if _, err := i.file.WriteAt(encodeEntry(off, pos), int64(i.size*ENTRY_WIDTH)); err != nil {
+		log.Printf("indexer.Write() - error writing index entry, error: %v", err)
+		return errors.WrapError(err, ERROR_WRITING_INDEX_ENTRY, i.Name())
 	}
 	i.mapper[off] = pos
+	i.offsets = append(i.offsets, off)
 	i.size++
 	return nil
 }
@@ -101,48 +201,69 @@ func (i *indexer) Read(inOff int64) (outOff uint32, pos uint64, err error) {
 		return 0, 0, io.EOF
 	}
 
+	last := i.offsets[i.size-1]
 	if inOff == -1 {
-		outOff = uint32(i.size)
-	} else {
-		outOff = uint32(inOff)
+		return last, i.mapper[last], nil
 	}
 
-	if outOff > uint32(i.size) {
+	outOff = uint32(inOff)
+	if outOff > last+1 {
 		// TOCHECK should return specific error, rather than io.EOF error?
-		log.Printf("indexer.Read() - error offset greater than index size, returning io.EOF, offset: %d, index size: %d", outOff, i.size)
+		log.Printf("indexer.Read() - error offset greater than last offset, returning io.EOF, offset: %d, last offset: %d", outOff, last)
 		return 0, 0, io.EOF
 	}
-
-	pos, ok := i.mapper[outOff]
-	if !ok {
+	if outOff > last {
 		return 0, 0, ErrRecordPosition
 	}
-	return outOff, pos, nil
+
+	// offsets missing from the index resolve to the next available offset
+	j := sort.Search(len(i.offsets), func(j int) bool {
+		return i.offsets[j] >= outOff
+	})
+	outOff = i.offsets[j]
+	return outOff, i.mapper[outOff], nil
 }
 
-func (i *indexer) Close() error {
-	i.file.Close()
+// Truncate discards index entries from offset off onwards
+func (i *indexer) Truncate(off uint32) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	fi, err := os.Create(i.Name())
-	if err != nil {
-		log.Printf("indexer.Close() - error creating index file, error: %v", err)
-		return errors.WrapError(err, ERROR_ENCODING_INDEX_FILE, i.Name())
+	size := uint64(sort.Search(len(i.offsets), func(j int) bool {
+		return i.offsets[j] >= off
+	}))
+	if size >= i.size {
+		return nil
 	}
-	encoder := gob.NewEncoder(fi)
-	err = encoder.Encode(&i.mapper)
-	if err != nil {
-		log.Printf("indexer.Close() - error encoding index data, error: %v", err)
-		return errors.WrapError(err, ERROR_ENCODING_INDEX_FILE, i.Name())
+	if err := i.file.Truncate(int64(size * ENTRY_WIDTH)); err != nil {
+		log.Printf("indexer.Truncate() - error truncating index file, error: %v", err)
+		return errors.WrapError(err, ERROR_TRUNCATING_INDEX, i.Name())
+	}
+	for _, off := range i.offsets[size:] {
+		delete(i.mapper, off)
 	}
+	i.offsets = i.offsets[:size]
+	i.size = size
+	return nil
+}
 
-	fs, err := os.Stat(fi.Name())
-	if err != nil {
-		log.Printf("indexer.Close() - error getting index file stats, error: %v", err)
-		return errors.WrapError(err, ERROR_NO_FILE, fi.Name())
+// Sync commits index entries to stable storage
+func (i *indexer) Sync() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.file.Sync(); err != nil {
+		log.Printf("indexer.Sync() - error syncing index file, error: %v", err)
+		return errors.WrapError(err, ERROR_SYNCING_INDEX_FILE, i.Name())
 	}
+	return nil
+}
 
-	i.file = fi
-	log.Printf("indexer file saved and closed, file: %s, file size: %d, index size: %d", i.Name(), fs.Size(), i.size)
+func (i *indexer) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	log.Printf("indexer file closed, file: %s, index size: %d", i.Name(), i.size)
 	return i.file.Close()
 }
 
@@ -153,3 +274,16 @@ func (i *indexer) Name() string {
 func (i *indexer) Size() uint64 {
 	return i.size
 }
+
+func encodeEntry(off uint32, pos uint64) []byte {
+	b := make([]byte, ENTRY_WIDTH)
+	ENCODING.PutUint32(b[:OFFSET_WIDTH], off)
+	ENCODING.PutUint64(b[OFFSET_WIDTH:ENTRY_WIDTH], pos)
+	return b
+}
+
+func decodeEntry(b []byte) (off uint32, pos uint64) {
+	off = ENCODING.Uint32(b[:OFFSET_WIDTH])
+	pos = ENCODING.Uint64(b[OFFSET_WIDTH:ENTRY_WIDTH])
+	return off, pos
+}
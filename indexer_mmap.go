@@ -0,0 +1,265 @@
+//go:build unix
+
+package recorder
+
+import (
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/comfforts/errors"
+)
+
+const (
+	ERROR_MAPPING_INDEX   string = "error memory mapping index file %s"
+	ERROR_UNMAPPING_INDEX string = "error unmapping index file %s"
+	ERROR_MMAP_FILE       string = "memory mapped index requires an operating system file, index file %s"
+)
+
+// fder is implemented by operating system files, which can be memory mapped
+type fder interface {
+	Fd() uintptr
+}
+
+// mmapIndexer: fixed width (offset, position) entries in a preallocated,
+// memory mapped index file. Offsets are looked up with binary search over entries.
+// Index file is trimmed to its entries on close, entries of a closed index are read from memory.
+type mmapIndexer struct {
+	file   File
+	mmap   []byte
+	size   uint64
+	closed bool
+	mu     sync.Mutex
+}
+
+func newMmapIndexer(f File, c Config) (*mmapIndexer, error) {
+	if _, ok := f.(fder); !ok {
+		log.Printf("mmapIndexer.newMmapIndexer() - error index file can't be memory mapped, file: %s", f.Name())
+		return nil, errors.NewAppError(ERROR_MMAP_FILE, f.Name())
+	}
+	idx := &mmapIndexer{
+		file: f,
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("mmapIndexer.newMmapIndexer() - error getting file stats, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_NO_FILE, f.Name())
+	}
+
+	b := make([]byte, fi.Size())
+	if fi.Size() > 0 {
+		if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+			log.Printf("mmapIndexer.newMmapIndexer() - error reading index file, error: %v", err)
+			return nil, errors.WrapError(err, ERROR_DECODING_INDEX_FILE, f.Name())
+		}
+		// legacy gob encoded index files are migrated to entries
+		if b[0] != 0 {
+			legacy := &indexer{file: f, mapper: Mapper{}}
+			if err := legacy.migrate(b); err != nil {
+				return nil, err
+			}
+			b = make([]byte, legacy.size*ENTRY_WIDTH)
+			if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+				log.Printf("mmapIndexer.newMmapIndexer() - error reading migrated index file, error: %v", err)
+				return nil, errors.WrapError(err, ERROR_DECODING_INDEX_FILE, f.Name())
+			}
+		}
+	}
+	idx.size = countEntries(b)
+	log.Printf("mmapIndexer file size: %d, entries: %d", fi.Size(), idx.size)
+
+	entries := c.Segment.MaxIndexSize
+	if entries < idx.size+1 {
+		entries = idx.size + 1
+	}
+	if err := idx.remap(entries * ENTRY_WIDTH); err != nil {
+		return nil, err
+	}
+
+	// bytes past the last entry, torn or stale, are cleared
+	stale := idx.mmap[idx.size*ENTRY_WIDTH:]
+	copy(stale, make([]byte, len(stale)))
+	return idx, nil
+}
+
+// countEntries counts leading entries with increasing offsets and positions,
+// preallocated space past the last entry is zeroed. An unclosed empty index
+// reads as a single zero entry, which segments find unindexed and rebuild.
+func countEntries(b []byte) uint64 {
+	n := uint64(len(b)) / ENTRY_WIDTH
+	for j := uint64(1); j < n; j++ {
+		prevOff, prevPos := decodeEntry(b[(j-1)*ENTRY_WIDTH:])
+		off, pos := decodeEntry(b[j*ENTRY_WIDTH:])
+		if off <= prevOff || pos <= prevPos {
+			return j
+		}
+	}
+	return n
+}
+
+// remap resizes the index file to size bytes and maps it
+func (i *mmapIndexer) remap(size uint64) error {
+	if i.mmap != nil {
+		if err := syscall.Munmap(i.mmap); err != nil {
+			log.Printf("mmapIndexer.remap() - error unmapping index file, error: %v", err)
+			return errors.WrapError(err, ERROR_UNMAPPING_INDEX, i.Name())
+		}
+		i.mmap = nil
+	}
+	if err := i.file.Truncate(int64(size)); err != nil {
+		log.Printf("mmapIndexer.remap() - error resizing index file, error: %v", err)
+		return errors.WrapError(err, ERROR_MAPPING_INDEX, i.Name())
+	}
+	mmap, err := syscall.Mmap(int(i.file.(fder).Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		log.Printf("mmapIndexer.remap() - error mapping index file, error: %v", err)
+		return errors.WrapError(err, ERROR_MAPPING_INDEX, i.Name())
+	}
+	i.mmap = mmap
+	return nil
+}
+
+func (i *mmapIndexer) Write(off uint32, pos uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return errors.WrapError(os.ErrClosed, ERROR_WRITING_INDEX_ENTRY, i.Name())
+	}
+
+	if i.size > 0 {
+		last, _ := i.entry(i.size - 1)
+		if off == last {
+			return ErrDuplicateOffset
+		}
+		// offsets are appended in increasing order
+		if off < last {
+			if j := i.search(off); j < i.size {
+				if o, _ := i.entry(j); o == off {
+					return ErrDuplicateOffset
+				}
+			}
+			log.Printf("mmapIndexer.Write() - error offset less than last offset, returning io.EOF, offset: %d, last offset: %d", off, last)
+			return io.EOF
+		}
+	}
+
+	// mapping doubles when full
+	if (i.size+1)*ENTRY_WIDTH > uint64(len(i.mmap)) {
+		if err := i.remap(uint64(len(i.mmap)) * 2); err != nil {
+			return err
+		}
+	}
+	copy(i.mmap[i.size*ENTRY_WIDTH:], encodeEntry(off, pos))
+	i.size++
+	return nil
+}
+
+func (i *mmapIndexer) Read(inOff int64) (outOff uint32, pos uint64, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// new index, return io.EOF error as signal for segment to initalize with baseoffset
+	if i.size == 0 {
+		log.Printf("mmapIndexer.Read() - index size is zero, returning io.EOF")
+		return 0, 0, io.EOF
+	}
+
+	last, lastPos := i.entry(i.size - 1)
+	if inOff == -1 {
+		return last, lastPos, nil
+	}
+
+	outOff = uint32(inOff)
+	if outOff > last+1 {
+		log.Printf("mmapIndexer.Read() - error offset greater than last offset, returning io.EOF, offset: %d, last offset: %d", outOff, last)
+		return 0, 0, io.EOF
+	}
+	if outOff > last {
+		return 0, 0, ErrRecordPosition
+	}
+
+	// offsets missing from the index resolve to the next available offset
+	outOff, pos = i.entry(i.search(outOff))
+	return outOff, pos, nil
+}
+
+// search returns the first entry with offset at or after off
+func (i *mmapIndexer) search(off uint32) uint64 {
+	return uint64(sort.Search(int(i.size), func(j int) bool {
+		o, _ := i.entry(uint64(j))
+		return o >= off
+	}))
+}
+
+func (i *mmapIndexer) entry(j uint64) (off uint32, pos uint64) {
+	return decodeEntry(i.mmap[j*ENTRY_WIDTH:])
+}
+
+// Truncate discards index entries from offset off onwards
+func (i *mmapIndexer) Truncate(off uint32) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return errors.WrapError(os.ErrClosed, ERROR_TRUNCATING_INDEX, i.Name())
+	}
+
+	size := i.search(off)
+	if size >= i.size {
+		return nil
+	}
+	discarded := i.mmap[size*ENTRY_WIDTH : i.size*ENTRY_WIDTH]
+	copy(discarded, make([]byte, len(discarded)))
+	i.size = size
+	return nil
+}
+
+// Sync commits mapped index entries to stable storage
+func (i *mmapIndexer) Sync() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.file.Sync(); err != nil {
+		log.Printf("mmapIndexer.Sync() - error syncing index file, error: %v", err)
+		return errors.WrapError(err, ERROR_SYNCING_INDEX_FILE, i.Name())
+	}
+	return nil
+}
+
+// Close unmaps the index file, trimming it to its entries.
+// Entries are kept in memory for reads of the sealed segment.
+func (i *mmapIndexer) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return nil
+	}
+	if i.mmap != nil {
+		entries := append([]byte(nil), i.mmap[:i.size*ENTRY_WIDTH]...)
+		if err := syscall.Munmap(i.mmap); err != nil {
+			log.Printf("mmapIndexer.Close() - error unmapping index file, error: %v", err)
+			return errors.WrapError(err, ERROR_UNMAPPING_INDEX, i.Name())
+		}
+		i.mmap = entries
+		if err := i.file.Truncate(int64(i.size * ENTRY_WIDTH)); err != nil {
+			log.Printf("mmapIndexer.Close() - error trimming index file, error: %v", err)
+			return errors.WrapError(err, ERROR_TRUNCATING_INDEX, i.Name())
+		}
+	}
+	log.Printf("mmapIndexer file closed, file: %s, index size: %d", i.Name(), i.size)
+	i.closed = true
+	return i.file.Close()
+}
+
+func (i *mmapIndexer) Name() string {
+	return i.file.Name()
+}
+
+func (i *mmapIndexer) Size() uint64 {
+	return i.size
+}
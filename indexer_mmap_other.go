@@ -0,0 +1,16 @@
+//go:build !unix
+
+package recorder
+
+import (
+	"github.com/comfforts/errors"
+)
+
+const (
+	ERROR_MMAP_UNSUPPORTED string = "memory mapped index is not supported on this platform, index file %s"
+)
+
+// newMmapIndexer fails on platforms without mmap
+func newMmapIndexer(f File, c Config) (Indexer, error) {
+	return nil, errors.NewAppError(ERROR_MMAP_UNSUPPORTED, f.Name())
+}
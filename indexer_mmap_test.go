@@ -0,0 +1,203 @@
+//go:build unix
+
+package recorder
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+func TestMmapIndexer(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "mmap_indexer_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 4
+	idx, err := newMmapIndexer(f, c)
+	require.NoError(t, err)
+
+	// index file is preallocated
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(4*ENTRY_WIDTH), fi.Size())
+
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+
+	// mapping grows past preallocated entries
+	offs := []uint32{0, 1, 3, 4, 6, 7}
+	for _, off := range offs {
+		err = idx.Write(off, uint64(off)*10)
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(len(offs)), idx.Size())
+	err = idx.Write(3, 30)
+	require.Equal(t, ErrDuplicateOffset, err)
+	err = idx.Write(5, 50)
+	require.Equal(t, io.EOF, err)
+
+	off, pos, err := idx.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), off)
+	require.Equal(t, uint64(30), pos)
+	_, _, err = idx.Read(8)
+	require.Equal(t, ErrRecordPosition, err)
+	_, _, err = idx.Read(9)
+	require.Equal(t, io.EOF, err)
+
+	err = idx.Truncate(5)
+	require.NoError(t, err)
+	off, _, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), off)
+
+	// index file is trimmed to entries on close
+	err = idx.Close()
+	require.NoError(t, err)
+	fi, err = os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(4*ENTRY_WIDTH), fi.Size())
+
+	// entries written by file indexer are read by mmap indexer
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	fidx, err := newIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), fidx.Size())
+	err = fidx.Write(5, 50)
+	require.NoError(t, err)
+	err = fidx.Close()
+	require.NoError(t, err)
+
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newMmapIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), idx.Size())
+	off, pos, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), off)
+	require.Equal(t, uint64(50), pos)
+	err = idx.Close()
+	require.NoError(t, err)
+}
+
+func TestMmapIndexerRecoversUnclosed(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "mmap_indexer_unclosed_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+	idx, err := newMmapIndexer(f, c)
+	require.NoError(t, err)
+	for off := uint32(0); off < 3; off++ {
+		err = idx.Write(off, uint64(off)*10)
+		require.NoError(t, err)
+	}
+
+	// simulate crash, index is never closed and stays preallocated
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newMmapIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.Size())
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+
+	err = idx.Write(3, 30)
+	require.NoError(t, err)
+	err = idx.Close()
+	require.NoError(t, err)
+}
+
+func TestMmapIndexerMigratesGobIndex(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "mmap_indexer_gob_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	datas := Mapper{
+		0: 0,
+		1: 19,
+		2: 38,
+	}
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+	encoder := gob.NewEncoder(f)
+	err = encoder.Encode(&datas)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+	idx, err := newMmapIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.Size())
+	for off, want := range datas {
+		_, pos, err := idx.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, pos)
+	}
+	err = idx.Close()
+	require.NoError(t, err)
+
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*ENTRY_WIDTH), fi.Size())
+}
+
+func TestMmapIndexerSegmentSize(t *testing.T) {
+	dir := TEST_DATA_DIR + "/"
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+	c.Segment.IndexFormat = INDEX_MMAP
+	s, err := newSegmenter(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// preallocated index is counted at its size on disk
+	fi, err := os.Stat(filepath.Join(dir, "0"+INDEX_EXT))
+	require.NoError(t, err)
+	require.Equal(t, int64(10*ENTRY_WIDTH), fi.Size())
+	require.Equal(t, s.filerSize()+10*ENTRY_WIDTH+TIME_ENTRY_WIDTH, s.Size())
+
+	// closed index is truncated to its entries
+	err = s.Close()
+	require.NoError(t, err)
+	require.Equal(t, s.filerSize()+ENTRY_WIDTH+TIME_ENTRY_WIDTH, s.Size())
+}
@@ -3,6 +3,7 @@ package recorder
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -100,3 +101,149 @@ func TestIndexer(t *testing.T) {
 	err = os.RemoveAll(TEST_DATA_DIR)
 	require.NoError(t, err)
 }
+
+func TestIndexerRecoversUnclosed(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "indexer_unclosed_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+
+	c := Config{}
+	idx, err := newIndexer(f, c)
+	require.NoError(t, err)
+
+	for off := uint32(0); off < 3; off++ {
+		err = idx.Write(off, uint64(off)*10)
+		require.NoError(t, err)
+	}
+
+	// simulate crash, index is never closed, last entry is torn
+	_, err = f.WriteAt([]byte{0, 0}, int64(3*ENTRY_WIDTH))
+	require.NoError(t, err)
+
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.Size())
+
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*ENTRY_WIDTH), fi.Size())
+
+	err = idx.Write(3, 30)
+	require.NoError(t, err)
+	err = idx.Close()
+	require.NoError(t, err)
+}
+
+func TestIndexerMigratesGobIndex(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "indexer_gob_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	datas := Mapper{
+		0: 0,
+		1: 19,
+		2: 38,
+	}
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+	encoder := gob.NewEncoder(f)
+	err = encoder.Encode(&datas)
+	require.NoError(t, err)
+
+	c := Config{}
+	idx, err := newIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.Size())
+	for off, want := range datas {
+		_, pos, err := idx.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, pos)
+	}
+	err = idx.Close()
+	require.NoError(t, err)
+
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*ENTRY_WIDTH), fi.Size())
+}
+
+func TestIndexerOffsetGaps(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "indexer_gaps_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+
+	c := Config{}
+	idx, err := newIndexer(f, c)
+	require.NoError(t, err)
+
+	for _, off := range []uint32{0, 2, 5} {
+		err = idx.Write(off, uint64(off)*10)
+		require.NoError(t, err)
+	}
+	// offsets only increase
+	err = idx.Write(4, 40)
+	require.Equal(t, io.EOF, err)
+	err = idx.Close()
+	require.NoError(t, err)
+
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndexer(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.Size())
+
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), off)
+	require.Equal(t, uint64(50), pos)
+
+	_, pos, err = idx.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), pos)
+
+	// missing offsets resolve to the next available offset
+	off, pos, err = idx.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), off)
+	require.Equal(t, uint64(50), pos)
+	_, _, err = idx.Read(6)
+	require.Equal(t, ErrRecordPosition, err)
+	_, _, err = idx.Read(7)
+	require.Equal(t, io.EOF, err)
+
+	// truncate discards entries from a missing offset onwards
+	err = idx.Truncate(3)
+	require.NoError(t, err)
+	off, _, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	err = idx.Write(3, 30)
+	require.NoError(t, err)
+	err = idx.Close()
+	require.NoError(t, err)
+}
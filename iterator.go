@@ -0,0 +1,85 @@
+package recorder
+
+import (
+	"io"
+	"log"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+// Iterator walks records over an offset range
+type Iterator interface {
+	// Next advances to the next record, returning false at the end of range or on error
+	Next() bool
+	// Record returns the current record
+	Record() *api.Record
+	// Err returns the error that stopped iteration, if any
+	Err() error
+}
+
+// iterator walks recorder segments sequentially, holding one record at a time
+type iterator struct {
+	r        *recorder
+	next, to uint64
+	idx      int
+	segment  Segmenter
+	record   *api.Record
+	err      error
+}
+
+func (it *iterator) Next() bool {
+	if it.err != nil || it.next > it.to {
+		return false
+	}
+
+	it.r.mu.RLock()
+	defer it.r.mu.RUnlock()
+
+	if len(it.r.segments) == 0 || it.next < it.r.segments[0].BaseOffset() {
+		log.Printf("iterator.Next() - offset out of range, offset: %d", it.next)
+		it.err = &OffsetOutOfRangeError{Offset: it.next}
+		return false
+	}
+
+	var record *api.Record
+	for record == nil {
+		// current segment is reused until its offsets are exhausted,
+		// or the segment is dropped from the recorder
+		if it.segment == nil ||
+			it.idx >= len(it.r.segments) ||
+			it.r.segments[it.idx] != it.segment ||
+			it.next >= it.segment.NextOffset() {
+			it.idx, it.segment = it.r.segmentFrom(it.next)
+		}
+		if it.segment == nil {
+			// end of log
+			return false
+		}
+
+		// offset gaps left by compaction are skipped,
+		// up to the end of a segment truncated within a gap
+		var err error
+		if record, err = it.segment.Read(it.next); err == io.EOF {
+			it.next = it.segment.NextOffset()
+		} else if err != nil {
+			log.Printf("iterator.Next() - error reading record, offset: %d, error: %v", it.next, err)
+			it.err = err
+			return false
+		}
+	}
+	if record.Offset > it.to {
+		it.next = record.Offset
+		return false
+	}
+	it.record = record
+	it.next = record.Offset + 1
+	return true
+}
+
+func (it *iterator) Record() *api.Record {
+	return it.record
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
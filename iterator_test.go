@@ -0,0 +1,161 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+func TestIterator(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// iterates across sealed and active segments
+	it := r.Iterator(2, 8)
+	off := uint64(2)
+	for it.Next() {
+		require.Equal(t, off, it.Record().Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(it.Record().Value))
+		off++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(9), off)
+
+	// stops at end of log
+	it = r.Iterator(8, 20)
+	off = uint64(8)
+	for it.Next() {
+		require.Equal(t, off, it.Record().Offset)
+		off++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(10), off)
+
+	// sealed segment read filer is reused
+	s := r.segments[1].(*segmenter)
+	require.True(t, s.Closed())
+	reader := s.reader
+	require.NotNil(t, reader)
+	_, err = r.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, reader, s.reader)
+
+	// errors below lowest offset
+	err = r.Truncate(5)
+	require.NoError(t, err)
+	it = r.Iterator(0, 5)
+	require.False(t, it.Next())
+	require.Error(t, it.Err())
+
+	err = r.Close()
+	require.NoError(t, err)
+}
+
+func TestReadRange(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// appended records are sized with their offset and timestamp
+	record := &api.Record{Value: []byte("hello world"), Offset: 1, Timestamp: time.Now().UnixNano()}
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	c.Read.MaxBytes = 3 * uint64(proto.Size(record))
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = r.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	records, err := r.ReadRange(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, uint64(1), records[0].Offset)
+	require.Equal(t, uint64(2), records[1].Offset)
+
+	// range is bounded by max bytes
+	records, err = r.ReadRange(2, 9)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	require.Equal(t, uint64(4), records[2].Offset)
+
+	_, err = r.ReadRange(10, 12)
+	require.Error(t, err)
+	_, err = r.ReadRange(5, 4)
+	require.Error(t, err)
+
+	err = r.Close()
+	require.NoError(t, err)
+}
+
+func TestIteratorOffsetGaps(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, key := range []string{"k1", "k2", "k1", "k1", "k1", "k1", "k3", "k2", "k3", "k4"} {
+		_, err = r.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+
+	// first segment is emptied, others are left with gaps
+	err = r.Compact()
+	require.NoError(t, err)
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	offsets := func(it Iterator) []uint64 {
+		offs := []uint64{}
+		for it.Next() {
+			offs = append(offs, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		return offs
+	}
+	require.Equal(t, []uint64{5, 7, 8, 9}, offsets(r.Iterator(3, 20)))
+	require.Equal(t, []uint64{7}, offsets(r.Iterator(6, 7)))
+	require.Equal(t, []uint64{}, offsets(r.Iterator(3, 4)))
+
+	records, err := r.ReadRange(4, 8)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	require.Equal(t, uint64(5), records[0].Offset)
+
+	// exact reads of dropped offsets fail
+	_, err = r.Read(6)
+	require.Error(t, err)
+
+	it := r.Iterator(0, 20)
+	require.False(t, it.Next())
+	require.Error(t, it.Err())
+}
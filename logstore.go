@@ -0,0 +1,158 @@
+package recorder
+
+import (
+	"log"
+
+	"github.com/comfforts/errors"
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+const (
+	ERROR_LOG_NOT_FOUND      string = "log not found"
+	ERROR_NONCONTIGUOUS_LOG  string = "error log index %d doesn't follow last index %d"
+	ERROR_DELETING_LOG_RANGE string = "error deleting log range %d - %d"
+)
+
+var (
+	ErrLogNotFound = errors.NewAppError(ERROR_LOG_NOT_FOUND)
+)
+
+// LogEntry is a Raft log entry, stored as a record
+// with index as record offset
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Type  uint32
+	Data  []byte
+}
+
+// LogStore stores Raft log entries
+type LogStore interface {
+	// FirstIndex returns the first index written, 0 for no entries
+	FirstIndex() (uint64, error)
+	// LastIndex returns the last index written, 0 for no entries
+	LastIndex() (uint64, error)
+	// GetLog gets a log entry at a given index
+	GetLog(index uint64, log *LogEntry) error
+	// StoreLog stores a log entry
+	StoreLog(log *LogEntry) error
+	// StoreLogs stores multiple log entries
+	StoreLogs(logs []*LogEntry) error
+	// DeleteRange deletes a range of log entries, inclusive
+	DeleteRange(min, max uint64) error
+}
+
+// logStore adapts a recorder as Raft log store. Entries are appended at
+// contiguous indexes, recorder's initial offset is the first log index.
+type logStore struct {
+	recorder Recorder
+}
+
+func NewLogStore(r Recorder) *logStore {
+	return &logStore{
+		recorder: r,
+	}
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	next, err := l.recorder.NextOffset()
+	if err != nil {
+		return 0, err
+	}
+	lowest, err := l.recorder.LowestOffset()
+	if err != nil || next == lowest {
+		return 0, err
+	}
+	return lowest, nil
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	next, err := l.recorder.NextOffset()
+	if err != nil {
+		return 0, err
+	}
+	lowest, err := l.recorder.LowestOffset()
+	if err != nil || next == lowest {
+		return 0, err
+	}
+	return next - 1, nil
+}
+
+func (l *logStore) GetLog(index uint64, entry *LogEntry) error {
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last == 0 || index < first || index > last {
+		return ErrLogNotFound
+	}
+
+	record, err := l.recorder.Read(index)
+	if err != nil {
+		log.Printf("logStore.GetLog() - error reading log, index: %d, error: %v", index, err)
+		return err
+	}
+	entry.Index = record.Offset
+	entry.Term = record.Term
+	entry.Type = record.Type
+	entry.Data = record.Value
+	return nil
+}
+
+func (l *logStore) StoreLog(entry *LogEntry) error {
+	return l.StoreLogs([]*LogEntry{entry})
+}
+
+func (l *logStore) StoreLogs(entries []*LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	next, err := l.recorder.NextOffset()
+	if err != nil {
+		return err
+	}
+
+	records := make([]*api.Record, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Index != next+uint64(i) {
+			log.Printf("logStore.StoreLogs() - non contiguous log index: %d, next index: %d", entry.Index, next+uint64(i))
+			return errors.NewAppError(ERROR_NONCONTIGUOUS_LOG, entry.Index, next+uint64(i)-1)
+		}
+		records = append(records, &api.Record{
+			Value: entry.Data,
+			Term:  entry.Term,
+			Type:  entry.Type,
+		})
+	}
+	if _, _, err = l.recorder.AppendBatch(records); err != nil {
+		log.Printf("logStore.StoreLogs() - error storing logs, error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteRange deletes log prefixes up to max by dropping whole segments, so
+// entries up to max sharing a segment with later entries are kept, and log
+// suffixes from min by truncating the log after min
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.recorder.Truncate(max)
+	}
+	if max >= last {
+		return l.recorder.TruncateAfter(min - 1)
+	}
+	log.Printf("logStore.DeleteRange() - only log prefixes or suffixes can be deleted, min: %d, max: %d", min, max)
+	return errors.NewAppError(ERROR_DELETING_LOG_RANGE, min, max)
+}
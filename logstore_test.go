@@ -0,0 +1,171 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, store LogStore,
+	){
+		"empty store has zero indexes":    testLogStoreEmpty,
+		"store and get log":               testLogStoreStoreGet,
+		"store logs across segments":      testLogStoreStoreLogs,
+		"get missing log":                 testLogStoreMissing,
+		"store non contiguous log fails":  testLogStoreNonContiguous,
+		"delete log prefix":               testLogStoreDeletePrefix,
+		"delete log suffix":               testLogStoreDeleteSuffix,
+		"delete log middle isn't allowed": testLogStoreDeleteMiddle,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+			err := createDirectory(dir)
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexSize = 3
+			c.Segment.InitialOffset = 1
+			r, err := NewRecorder(dir, c)
+			require.NoError(t, err)
+			defer r.Close()
+
+			fn(t, NewLogStore(r))
+		})
+	}
+}
+
+func testLogEntries(first, last uint64) []*LogEntry {
+	entries := []*LogEntry{}
+	for i := first; i <= last; i++ {
+		entries = append(entries, &LogEntry{
+			Index: i,
+			Term:  i/3 + 1,
+			Type:  uint32(i % 2),
+			Data:  []byte(fmt.Sprintf("log %d", i)),
+		})
+	}
+	return entries
+}
+
+func requireLogIndexes(t *testing.T, store LogStore, first, last uint64) {
+	t.Helper()
+	idx, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, idx)
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, idx)
+}
+
+func testLogStoreEmpty(t *testing.T, store LogStore) {
+	requireLogIndexes(t, store, 0, 0)
+}
+
+func testLogStoreStoreGet(t *testing.T, store LogStore) {
+	want := testLogEntries(1, 1)[0]
+	err := store.StoreLog(want)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 1, 1)
+
+	got := &LogEntry{}
+	err = store.GetLog(1, got)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func testLogStoreStoreLogs(t *testing.T, store LogStore) {
+	entries := testLogEntries(1, 8)
+	err := store.StoreLogs(entries)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 1, 8)
+
+	for _, want := range entries {
+		got := &LogEntry{}
+		err = store.GetLog(want.Index, got)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func testLogStoreMissing(t *testing.T, store LogStore) {
+	err := store.GetLog(1, &LogEntry{})
+	require.Equal(t, ErrLogNotFound, err)
+
+	err = store.StoreLogs(testLogEntries(1, 2))
+	require.NoError(t, err)
+	err = store.GetLog(3, &LogEntry{})
+	require.Equal(t, ErrLogNotFound, err)
+	err = store.GetLog(0, &LogEntry{})
+	require.Equal(t, ErrLogNotFound, err)
+}
+
+func testLogStoreNonContiguous(t *testing.T, store LogStore) {
+	err := store.StoreLog(testLogEntries(2, 2)[0])
+	require.Error(t, err)
+
+	err = store.StoreLogs(testLogEntries(1, 2))
+	require.NoError(t, err)
+	entries := testLogEntries(3, 5)
+	entries[1].Index = 6
+	err = store.StoreLogs(entries)
+	require.Error(t, err)
+	requireLogIndexes(t, store, 1, 2)
+}
+
+func testLogStoreDeletePrefix(t *testing.T, store LogStore) {
+	err := store.StoreLogs(testLogEntries(1, 8))
+	require.NoError(t, err)
+
+	// segments holding only deleted logs are dropped
+	err = store.DeleteRange(1, 5)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 4, 8)
+	err = store.GetLog(3, &LogEntry{})
+	require.Equal(t, ErrLogNotFound, err)
+
+	// deleting all logs keeps the next index
+	err = store.DeleteRange(4, 8)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 0, 0)
+	err = store.StoreLogs(testLogEntries(9, 10))
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 9, 10)
+}
+
+func testLogStoreDeleteSuffix(t *testing.T, store LogStore) {
+	err := store.StoreLogs(testLogEntries(1, 8))
+	require.NoError(t, err)
+
+	err = store.DeleteRange(3, 8)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 1, 2)
+	err = store.GetLog(3, &LogEntry{})
+	require.Equal(t, ErrLogNotFound, err)
+
+	// conflicting entries are replaced
+	entries := testLogEntries(3, 5)
+	for _, entry := range entries {
+		entry.Term = 5
+	}
+	err = store.StoreLogs(entries)
+	require.NoError(t, err)
+	requireLogIndexes(t, store, 1, 5)
+	got := &LogEntry{}
+	err = store.GetLog(4, got)
+	require.NoError(t, err)
+	require.Equal(t, entries[1], got)
+}
+
+func testLogStoreDeleteMiddle(t *testing.T, store LogStore) {
+	err := store.StoreLogs(testLogEntries(1, 5))
+	require.NoError(t, err)
+
+	err = store.DeleteRange(3, 4)
+	require.Error(t, err)
+	requireLogIndexes(t, store, 1, 5)
+}
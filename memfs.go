@@ -0,0 +1,310 @@
+package recorder
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS: in memory FS. Directories are implicit, every directory exists.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	// lock holders by lock name, -1 for an exclusive holder
+	locks map[string]int
+}
+
+// memNode: contents of an in memory file
+type memNode struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty in memory FS
+func NewMemFS() *memFS {
+	return &memFS{
+		files: map[string]*memNode{},
+		locks: map[string]int{},
+	}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	n, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		n = &memNode{modTime: time.Now()}
+		m.files[name] = n
+	} else if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	f := &memFile{node: n, name: name, flag: flag}
+	if flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.files[path.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n.stat(name), nil
+}
+
+// ReadDir returns entries of files in directory name, sorted by file name
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir := path.Clean(name)
+	var entries []os.DirEntry
+	for fName, n := range m.files {
+		if path.Dir(fName) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(n.stat(fName)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.files[path.Clean(oldpath)]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, path.Clean(oldpath))
+	m.files[path.Clean(newpath)] = n
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[path.Clean(name)]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, path.Clean(name))
+	return nil
+}
+
+// RemoveAll removes file or directory p and every file under it
+func (m *memFS) RemoveAll(p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p = path.Clean(p)
+	for name := range m.files {
+		if name == p || strings.HasPrefix(name, p+"/") || p == "." {
+			delete(m.files, name)
+		}
+	}
+	return nil
+}
+
+// SyncDir doesn't sync, in memory files outlive no crash
+func (m *memFS) SyncDir(name string) error {
+	return nil
+}
+
+// Lock locks name in memory, lock files aren't created
+func (m *memFS) Lock(name string, shared bool) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	holders := m.locks[name]
+	if holders < 0 || (holders > 0 && !shared) {
+		return nil, ErrLocked
+	}
+	if shared {
+		m.locks[name]++
+	} else {
+		m.locks[name] = -1
+	}
+	return &memLock{fsys: m, name: name, shared: shared}, nil
+}
+
+// memLock: lock of a memFS, released on close
+type memLock struct {
+	fsys     *memFS
+	name     string
+	shared   bool
+	released bool
+}
+
+func (l *memLock) Close() error {
+	l.fsys.mu.Lock()
+	defer l.fsys.mu.Unlock()
+
+	if l.released {
+		return os.ErrClosed
+	}
+	l.released = true
+	if l.shared && l.fsys.locks[l.name] > 1 {
+		l.fsys.locks[l.name]--
+	} else {
+		delete(l.fsys.locks, l.name)
+	}
+	return nil
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &memFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(n.data)),
+		modTime: n.modTime,
+	}
+}
+
+// memFile: open in memory file, written at end with O_APPEND,
+// at write offset otherwise
+type memFile struct {
+	node   *memNode
+	name   string
+	flag   int
+	off    int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	off := f.off
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, off)
+	f.off = off + int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at offset off, with node locked
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.node.mu.Lock()
+	closed := f.closed
+	f.node.mu.Unlock()
+	if closed {
+		return nil, os.ErrClosed
+	}
+	return f.node.stat(f.name), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo: os.FileInfo of an in memory file
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,129 @@
+package recorder
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+// ReadOnlyRecorder reads a log directory without creating, truncating
+// or rewriting its files, alongside a writer or after it's gone
+type ReadOnlyRecorder interface {
+	Read(off uint64) (*api.Record, error)
+	ReadRange(from, to uint64) ([]*api.Record, error)
+	Iterator(from, to uint64) Iterator
+	Subscribe(ctx context.Context, from uint64) (Subscription, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	OffsetForTime(t time.Time) (uint64, error)
+	DiskSize() uint64
+	Reader() io.Reader
+	// Refresh picks up records and segments appended, and segments
+	// compacted or removed, by the writer since last refresh
+	Refresh() error
+	Close() error
+	Directory() string
+	Configuration() Config
+}
+
+// OpenReadOnly opens the log in dir for reading. The directory isn't locked,
+// the log is read as of opening, or last refresh. Recorders opened read only
+// reject mutating calls with ErrReadOnly. Config is optional, files are read
+// with the writer's config if given, with defaults otherwise.
+func OpenReadOnly(dir string, config ...Config) (ReadOnlyRecorder, error) {
+	var c Config
+	if len(config) > 0 {
+		c = config[0]
+	}
+	if c.Segment.MaxIndexSize == 0 {
+		c.Segment.MaxIndexSize = 100
+	}
+	c.ReadOnly = true
+	r := &recorder{
+		Dir:      dir,
+		Config:   c,
+		lockFree: true,
+	}
+	if err := r.setup(); err != nil {
+		log.Printf("recorder.OpenReadOnly() - error opening log %s, error: %v", dir, err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// Refresh reopens the last segment of a read only recorder and segments added,
+// or changed by compaction or compression, keeping unchanged sealed segments.
+// Subscriptions are woken if records were appended.
+func (r *recorder) Refresh() error {
+	if !r.Config.ReadOnly {
+		return nil
+	}
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	r.mu.RLock()
+	prev, done := r.segments, r.done
+	r.mu.RUnlock()
+	if done == nil {
+		return ErrRecorderClosed
+	}
+
+	baseOffsets, err := r.baseOffsets()
+	if err != nil {
+		return err
+	}
+	kept := map[uint64]Segmenter{}
+	for _, s := range prev[:len(prev)-1] {
+		if fi, err := r.filerStat(s.BaseOffset()); err == nil && sameFile(fi, r.stats[s.BaseOffset()]) {
+			kept[s.BaseOffset()] = s
+		}
+	}
+	segments, stats, err := r.openSegments(baseOffsets, kept)
+	if err != nil {
+		log.Printf("recorder.Refresh() - error reopening segments, error: %v", err)
+		return err
+	}
+	reused := map[Segmenter]bool{}
+	for _, s := range segments {
+		if kept[s.BaseOffset()] == s {
+			reused[s] = true
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		for _, s := range segments {
+			if !reused[s] {
+				s.Close()
+			}
+		}
+		return ErrRecorderClosed
+	}
+	next := segments[len(segments)-1].NextOffset()
+	grew := next > prev[len(prev)-1].NextOffset()
+	r.segments, r.activeSegment, r.stats = segments, segments[len(segments)-1], stats
+	if grew {
+		close(r.appended)
+		r.appended = make(chan struct{})
+	}
+	for _, s := range prev {
+		if reused[s] {
+			continue
+		}
+		if err := s.Close(); err != nil {
+			log.Printf("recorder.Refresh() - error closing replaced segment, base offset: %d, error: %v", s.BaseOffset(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// sameFile checks that file stats tell the same, unchanged file
+func sameFile(fi, prev os.FileInfo) bool {
+	return prev != nil && fi.Name() == prev.Name() && fi.Size() == prev.Size() && fi.ModTime().Equal(prev.ModTime())
+}
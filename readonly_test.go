@@ -0,0 +1,226 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/comfforts/recorder/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyRecorder(t *testing.T) {
+	for scenario, fn := range map[string]func(c *Config){
+		"file index":  func(c *Config) {},
+		"mmap index":  func(c *Config) { c.Segment.IndexFormat = INDEX_MMAP },
+		"compression": func(c *Config) { c.Compression.Enabled = true },
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+			err := createDirectory(dir)
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexSize = 3
+			fn(&c)
+			testReadOnlyRecorder(t, dir, c)
+		})
+	}
+}
+
+func testReadOnlyRecorder(t *testing.T, dir string, c Config) {
+	w, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	appendValues(t, w, 0, 5)
+	// sealed segments are compressed in the background
+	w.wg.Wait()
+
+	// reading alongside the writer leaves the log's files untouched
+	files := dirSnapshot(t, dir)
+	r, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	records, err := r.ReadRange(0, 4)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(records))
+	for i, record := range records {
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	require.Equal(t, files, dirSnapshot(t, dir))
+
+	// mutating calls are rejected
+	ro := r.(Recorder)
+	_, err = ro.Append(&api.Record{Value: []byte("record")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.Truncate(0))
+	require.Equal(t, ErrReadOnly, ro.TruncateAfter(0))
+	require.Equal(t, ErrReadOnly, ro.Compact())
+	require.Equal(t, ErrReadOnly, ro.Reset())
+	require.Equal(t, ErrReadOnly, ro.Remove())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := r.Subscribe(ctx, 5)
+	require.NoError(t, err)
+
+	// writer's appends, over new segments, are read after refresh
+	appendValues(t, w, 5, 10)
+	w.wg.Wait()
+	highest, err = r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	err = r.Refresh()
+	require.NoError(t, err)
+	highest, err = r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	for i := 5; i < 10; i++ {
+		select {
+		case record := <-sub.Records():
+			require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+		case <-time.After(time.Second):
+			t.Fatalf("no record %d after refresh", i)
+		}
+	}
+
+	// writer's truncation is picked up on refresh
+	err = w.Truncate(2)
+	require.NoError(t, err)
+	w.wg.Wait()
+	err = r.Refresh()
+	require.NoError(t, err)
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	err = w.Close()
+	require.NoError(t, err)
+	files = dirSnapshot(t, dir)
+	err = r.Refresh()
+	require.NoError(t, err)
+	it := r.Iterator(lowest, 9)
+	var n int
+	for it.Next() {
+		n++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 7, n)
+	err = r.Close()
+	require.NoError(t, err)
+	require.Equal(t, files, dirSnapshot(t, dir))
+	require.Equal(t, ErrRecorderClosed, r.Refresh())
+}
+
+func TestReadOnlyRecorderRefresh(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	w, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	appendValues(t, w, 0, 1)
+	for i := 1; i < 5; i++ {
+		_, err = w.Append(&api.Record{Key: []byte(fmt.Sprintf("k%d", i%2)), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	ro, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	r := ro.(*recorder)
+	prev := append([]Segmenter{}, r.segments...)
+	require.Equal(t, 2, len(prev))
+
+	// sealed segment is kept, last segment is reopened
+	appendValues(t, w, 5, 7)
+	err = r.Refresh()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(r.segments))
+	require.Same(t, prev[0], r.segments[0])
+	require.NotSame(t, prev[1], r.segments[1])
+	require.Equal(t, uint64(6), r.segments[1].NextOffset())
+
+	// compacted segment is reopened
+	prev = append([]Segmenter{}, r.segments...)
+	err = w.Compact()
+	require.NoError(t, err)
+	err = r.Refresh()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(r.segments))
+	require.NotSame(t, prev[0], r.segments[0])
+	require.Same(t, prev[1], r.segments[1])
+	_, err = r.Read(1)
+	require.Error(t, err)
+	record, err := r.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "record 0", string(record.Value))
+	record, err = r.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, "record 4", string(record.Value))
+
+	require.NoError(t, w.Close())
+	require.NoError(t, r.Close())
+}
+
+func TestReadOnlyRecorderDefaults(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewRecorder(dir, Config{})
+	require.NoError(t, err)
+	defer w.Close()
+	appendValues(t, w, 0, 3)
+
+	// log written with defaults is read without config
+	r, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	defer r.Close()
+	records, err := r.ReadRange(0, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	require.Equal(t, "record 2", string(records[2].Value))
+}
+
+func TestReadOnlyRecorderEmpty(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = OpenReadOnly(dir)
+	require.Error(t, err)
+	require.Empty(t, dirSnapshot(t, dir))
+}
+
+// appendValues appends records valued with offsets from to to
+func appendValues(t *testing.T, r Recorder, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+}
+
+// dirSnapshot returns sizes and modification times of files in dir, by name
+func dirSnapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, e := range entries {
+		fi, err := os.Stat(path.Join(dir, e.Name()))
+		require.NoError(t, err)
+		files[e.Name()] = fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return files
+}
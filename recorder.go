@@ -1,6 +1,8 @@
 package recorder
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -9,24 +11,81 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/comfforts/errors"
 	api "github.com/comfforts/recorder/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	ERROR_OFFSET_OUT_OF_RANGE string = "requested offset is outside the log's range: %d"
+	ERROR_EMPTY_BATCH         string = "error appending empty batch"
+	ERROR_RECORDER_CLOSED     string = "recorder closed"
+	ERROR_RECORD_NOT_FOUND    string = "no record at offset: %d"
+	ERROR_READ_ONLY           string = "recorder opened read only"
+	ERROR_LOG_IN_USE          string = "log %s is in use by another recorder"
+	ERROR_NO_SEGMENTS         string = "no log segments in %s"
 )
 
+var (
+	ErrEmptyBatch     = errors.NewAppError(ERROR_EMPTY_BATCH)
+	ErrRecorderClosed = errors.NewAppError(ERROR_RECORDER_CLOSED)
+	ErrReadOnly       = errors.NewAppError(ERROR_READ_ONLY)
+)
+
+// LOCK_FILE is the name of the lock file in a log directory
+const LOCK_FILE = "LOCK"
+
+// LogInUseError is returned opening a log locked by another recorder,
+// by a writer, or by readers when opening for writing
+type LogInUseError struct {
+	Dir string
+}
+
+func (e *LogInUseError) Error() string {
+	return fmt.Sprintf(ERROR_LOG_IN_USE, e.Dir)
+}
+
+// OffsetOutOfRangeError is returned reading an offset outside the log's range
+type OffsetOutOfRangeError struct {
+	Offset uint64
+}
+
+func (e *OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf(ERROR_OFFSET_OUT_OF_RANGE, e.Offset)
+}
+
+// RecordNotFoundError is returned reading an offset, within the log's range,
+// whose record was dropped by compaction
+type RecordNotFoundError struct {
+	Offset uint64
+}
+
+func (e *RecordNotFoundError) Error() string {
+	return fmt.Sprintf(ERROR_RECORD_NOT_FOUND, e.Offset)
+}
+
 type Recorder interface {
 	Append(record *api.Record) (uint64, error)
+	AppendBatch(records []*api.Record) (first, last uint64, err error)
+	AppendReplicated(records []*api.Record) (first, last uint64, err error)
 	Read(off uint64) (*api.Record, error)
+	ReadRange(from, to uint64) ([]*api.Record, error)
+	Iterator(from, to uint64) Iterator
+	Subscribe(ctx context.Context, from uint64) (Subscription, error)
+	Sync() error
 	Close() error
 	Remove() error
 	Reset() error
 	LowestOffset() (uint64, error)
 	HighestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	OffsetForTime(t time.Time) (uint64, error)
+	DiskSize() uint64
 	Truncate(lowest uint64) error
+	Compact() error
+	TruncateAfter(off uint64) error
 	Reader() io.Reader
 	Directory() string
 	Configuration() Config
@@ -40,12 +99,47 @@ type recorder struct {
 
 	activeSegment Segmenter
 	segments      []Segmenter
+
+	// directory lock, held until closed
+	lock io.Closer
+	// read only recorder reading alongside a writer, without the directory lock
+	lockFree bool
+
+	// serializes compactions
+	cmu sync.Mutex
+	// discards of appended records, by truncation or rollback, telling compactions their scans are stale
+	discards uint64
+	// serializes refreshes of read only recorders
+	rmu sync.Mutex
+	// read only segments' filer stats as of opening, by base offset
+	stats map[uint64]os.FileInfo
+	// background syncer, janitor, compactor and compressions, waited for on close
+	wg sync.WaitGroup
+
+	// append requests waiting for group commit
+	qmu        sync.Mutex
+	queue      []*appendRequest
+	committing bool
+
+	// records appended since last sync
+	unsynced uint64
+	lastSync time.Time
+
+	// appended is closed and replaced after every committed batch, done on close
+	appended chan struct{}
+	done     chan struct{}
 }
 
 func NewRecorder(dir string, c Config) (*recorder, error) {
 	if c.Segment.MaxIndexSize == 0 {
 		c.Segment.MaxIndexSize = 100
 	}
+	if c.Compression.Enabled && c.Compression.BlockSize == 0 {
+		c.Compression.BlockSize = DEFAULT_BLOCK_SIZE
+	}
+	if c.Retention.MaxAge > 0 && c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
 	r := &recorder{
 		Dir:    dir,
 		Config: c,
@@ -54,116 +148,710 @@ func NewRecorder(dir string, c Config) (*recorder, error) {
 	return r, r.setup()
 }
 
-func (r *recorder) setup() error {
-	files, err := os.ReadDir(r.Dir)
+func (r *recorder) setup() (err error) {
+	// writers lock the directory exclusively, read only recorders share the lock
+	if !r.lockFree {
+		if r.lock, err = r.Config.fs().Lock(path.Join(r.Dir, LOCK_FILE), r.Config.ReadOnly); err != nil {
+			log.Printf("recorder.setup() - error locking directory %s, error: %v", r.Dir, err)
+			if err == ErrLocked {
+				return &LogInUseError{Dir: r.Dir}
+			}
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			r.unlock()
+		}
+	}()
+
+	baseOffsets, err := r.baseOffsets()
 	if err != nil {
-		log.Printf("recorder.setup() - error reading direcotry, %s", r.Dir)
 		return err
 	}
+	if r.Config.ReadOnly {
+		// read only recorders never create segments
+		if r.segments, r.stats, err = r.openSegments(baseOffsets, nil); err != nil {
+			return err
+		}
+		r.activeSegment = r.segments[len(r.segments)-1]
+	} else {
+		for i := 0; i < len(baseOffsets); i++ {
+			if err = r.newSegmenter(baseOffsets[i]); err != nil {
+				log.Printf("recorder.setup() - error creating segment with baseoffset %d", baseOffsets[i])
+				return err
+			}
+		}
+		if r.segments == nil {
+			log.Printf("recorder.setup() - initializing segment, initial offset: %d", r.Config.Segment.InitialOffset)
+			if err = r.newSegmenter(r.Config.Segment.InitialOffset); err != nil {
+				log.Printf("recorder.setup() - error initializing segment, initial offset %d", r.Config.Segment.InitialOffset)
+				return err
+			}
+		}
+	}
+
+	r.lastSync = time.Now()
+	r.appended = make(chan struct{})
+	r.done = make(chan struct{})
+	if r.Config.ReadOnly {
+		return nil
+	}
+	if r.Config.Durability.Policy == SYNC_BATCH && r.Config.Durability.MaxInterval > 0 {
+		r.background(r.syncer, r.Config.Durability.MaxInterval)
+	}
+	if r.Config.Retention.MaxAge > 0 {
+		r.background(r.janitor, r.Config.Retention.CheckInterval)
+	}
+	if r.Config.Compaction.Interval > 0 {
+		r.background(r.compactor, r.Config.Compaction.Interval)
+	}
+	return nil
+}
+
+// background runs fn every interval until done is closed, close waits for fn to return
+func (r *recorder) background(fn func(done <-chan struct{}, interval time.Duration), interval time.Duration) {
+	r.wg.Add(1)
+	go func(done <-chan struct{}) {
+		defer r.wg.Done()
+		fn(done, interval)
+	}(r.done)
+}
+
+// baseOffsets returns base offsets of segments in the directory, in order.
+// Leftovers of interrupted compactions and compressions are removed, unless read only.
+func (r *recorder) baseOffsets() ([]uint64, error) {
+	files, err := r.Config.fs().ReadDir(r.Dir)
+	if err != nil {
+		log.Printf("recorder.baseOffsets() - error reading direcotry, %s", r.Dir)
+		return nil, err
+	}
 	var baseOffsets []uint64
+	seen := map[uint64]bool{}
 	for _, file := range files {
+		switch path.Ext(file.Name()) {
+		case COMPACT_EXT, TMP_EXT:
+			if r.Config.ReadOnly {
+				continue
+			}
+			// leftover of an interrupted compaction or compression
+			if err = r.Config.fs().Remove(path.Join(r.Dir, file.Name())); err != nil {
+				log.Printf("recorder.baseOffsets() - error removing interrupted file %s, error: %v", file.Name(), err)
+				return nil, err
+			}
+			continue
+		case FILER_EXT, ZFILER_EXT:
+		default:
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			log.Printf("recorder.baseOffsets() - skipping file %s, error: %v", file.Name(), err)
+			continue
+		}
+		// a segment may have both filer and compressed filer, if compression was interrupted
+		if seen[off] {
+			continue
+		}
+		seen[off] = true
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = r.newSegmenter(baseOffsets[i]); err != nil {
-			log.Printf("recorder.setup() - error creating segment with baseoffset %d", baseOffsets[i])
-			return err
+	return baseOffsets, nil
+}
+
+// openSegments opens read only segments at base offsets, closing all but the last,
+// which may still take records from a writer. Sealed segments in kept are reused.
+// Segments are returned with their filer stats as of opening.
+func (r *recorder) openSegments(baseOffsets []uint64, kept map[uint64]Segmenter) ([]Segmenter, map[uint64]os.FileInfo, error) {
+	if len(baseOffsets) == 0 {
+		log.Printf("recorder.openSegments() - no segments in directory %s", r.Dir)
+		return nil, nil, errors.NewAppError(ERROR_NO_SEGMENTS, r.Dir)
+	}
+	var segments, opened []Segmenter
+	stats := map[uint64]os.FileInfo{}
+	for i, off := range baseOffsets {
+		if s, ok := kept[off]; ok && i < len(baseOffsets)-1 {
+			segments, stats[off] = append(segments, s), r.stats[off]
+			continue
+		}
+		// stats are taken before opening, a filer changed meanwhile is reopened on next refresh
+		fi, err := r.filerStat(off)
+		var s *segmenter
+		if err == nil {
+			s, err = newSegmenter(r.Dir, off, r.Config)
+		}
+		if err == nil {
+			opened = append(opened, s)
+			if i < len(baseOffsets)-1 {
+				err = s.Close()
+			}
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+		if err != nil {
+			log.Printf("recorder.openSegments() - error opening segment, offset: %d, error: %v", off, err)
+			for _, s := range opened {
+				s.Close()
+			}
+			return nil, nil, err
+		}
+		segments, stats[off] = append(segments, s), fi
 	}
-	if r.segments == nil {
-		log.Printf("recorder.setup() - initializing segment, initial offset: %d", r.Config.Segment.InitialOffset)
-		if err = r.newSegmenter(r.Config.Segment.InitialOffset); err != nil {
-			log.Printf("recorder.setup() - error initializing segment, initial offset %d", r.Config.Segment.InitialOffset)
-			return err
+	return segments, stats, nil
+}
+
+// filerStat returns stats of the filer of segment at base offset off, compressed or not
+func (r *recorder) filerStat(off uint64) (os.FileInfo, error) {
+	fPath := path.Join(r.Dir, fmt.Sprintf("%d%s", off, FILER_EXT))
+	fi, err := r.Config.fs().Stat(fPath)
+	if os.IsNotExist(err) {
+		fi, err = r.Config.fs().Stat(compressedPath(fPath))
+	}
+	return fi, err
+}
+
+// janitor removes expired segments every interval, until done is closed
+func (r *recorder) janitor(done <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.Config.clock().After(interval):
+			if err := r.expire(); err != nil {
+				log.Printf("recorder.janitor() - error removing expired segments, error: %v", err)
+			}
+		}
+	}
+}
+
+// expire removes sealed segments with newest record older than retention max age,
+// oldest segments first. Active segment is never removed.
+func (r *recorder) expire() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		return ErrRecorderClosed
+	}
+
+	cutoff := r.Config.clock().Now().Add(-r.Config.Retention.MaxAge)
+	var n int
+	for n < len(r.segments) && r.segments[n] != r.activeSegment && r.segments[n].LastAppended().Before(cutoff) {
+		log.Printf("recorder.expire() - removing expired segment, base offset: %d, last appended: %v", r.segments[n].BaseOffset(), r.segments[n].LastAppended())
+		n++
+	}
+	return r.removeOldest(n)
+}
+
+// syncer syncs unsynced records every interval, until done is closed
+func (r *recorder) syncer(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.unsynced > 0 && time.Since(r.lastSync) >= interval {
+				if err := r.sync(); err != nil {
+					log.Printf("recorder.syncer() - error syncing recorder, error: %v", err)
+				}
+			}
+			r.mu.Unlock()
 		}
 	}
-	return nil
 }
 
 func (r *recorder) newSegmenter(off uint64) error {
 	log.Printf("recorder.newSegmenter() - creating new segment, offset: %d", off)
+	// records in the previous segment are synced before it's sealed, and before
+	// the new segment exists, so that a crash never leaves an offset gap between them
+	if r.activeSegment != nil && r.unsynced > 0 {
+		if err := r.sync(); err != nil {
+			log.Printf("recorder.newSegmenter() - error syncing active segment, offset: %d, error: %v", off, err)
+			return err
+		}
+	}
 	s, err := newSegmenter(r.Dir, off, r.Config)
 	if err != nil {
 		log.Printf("recorder.newSegmenter() - error creating new segment, offset: %d, error: %v", off, err)
 		return err
 	}
+	// segment files are durable before records are appended to them
+	if err = r.syncDir(); err != nil {
+		s.Remove()
+		return err
+	}
 	r.segments = append(r.segments, s)
-	if r.activeSegment != nil && r.activeSegment.BaseOffset() != r.Config.Segment.InitialOffset {
+	if r.activeSegment != nil && r.Config.Compression.Enabled {
+		if err = r.activeSegment.Close(); err == nil {
+			r.compress(r.activeSegment)
+		}
+	} else if r.activeSegment != nil && r.activeSegment.BaseOffset() != r.Config.Segment.InitialOffset {
 		r.activeSegment.Close()
 	}
 	r.activeSegment = s
+	return r.enforceMaxBytes()
+}
+
+// syncDir syncs the log directory, making segment files created, renamed or removed durable
+func (r *recorder) syncDir() error {
+	if err := r.Config.fs().SyncDir(r.Dir); err != nil {
+		log.Printf("recorder.syncDir() - error syncing directory %s, error: %v", r.Dir, err)
+		return err
+	}
 	return nil
 }
 
+// compress compresses sealed segment s in the background, outside the writer lock.
+// Compressed filer is swapped in unless the segment was removed, compacted or
+// reopened meanwhile, sealed segment stays readable uncompressed if compression fails.
+func (r *recorder) compress(s Segmenter) {
+	f := s.Filer()
+	if path.Ext(f.Name()) != FILER_EXT {
+		return
+	}
+	size := f.Size()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		zPath := compressedPath(f.Name())
+		// encrypted records are compressed as they are
+		if err := compressFiler(r.Config.fs(), rawFiler(f), zPath, r.Config.Compression.BlockSize); err != nil {
+			log.Printf("recorder.compress() - error compressing sealed segment, base offset: %d, error: %v", s.BaseOffset(), err)
+			return
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.segmentIndex(s) < 0 || !s.Closed() || s.Filer().Name() != f.Name() || s.Filer().Size() != size {
+			log.Printf("recorder.compress() - segment changed while compressing, discarding compressed filer, base offset: %d", s.BaseOffset())
+			if err := r.Config.fs().Remove(zPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("recorder.compress() - error removing compressed filer, error: %v", err)
+			}
+			return
+		}
+		if err := s.UseCompressed(zPath); err != nil {
+			log.Printf("recorder.compress() - error swapping compressed filer, base offset: %d, error: %v", s.BaseOffset(), err)
+		}
+	}()
+}
+
+// enforceMaxBytes removes oldest segments until total segment bytes are
+// within retention max bytes. Active segment is never removed.
+func (r *recorder) enforceMaxBytes() error {
+	max := r.Config.Retention.MaxBytes
+	if max == 0 {
+		return nil
+	}
+	size := r.diskSize()
+	var n int
+	for n < len(r.segments) && r.segments[n] != r.activeSegment && size > max {
+		size -= r.segments[n].Size()
+		n++
+	}
+	if n > 0 {
+		log.Printf("recorder.enforceMaxBytes() - removing segments over retention max bytes, max: %d, segments: %d", max, n)
+	}
+	return r.removeOldest(n)
+}
+
+// removeOldest removes the n oldest segments
+func (r *recorder) removeOldest(n int) error {
+	for i := 0; i < n; i++ {
+		if err := r.segments[i].Remove(); err != nil {
+			log.Printf("recorder.removeOldest() - error removing segment, base offset: %d, error: %v", r.segments[i].BaseOffset(), err)
+			r.segments = r.segments[i:]
+			return err
+		}
+	}
+	r.segments = r.segments[n:]
+	if n > 0 {
+		return r.syncDir()
+	}
+	return nil
+}
+
+// appendRequest is a batch of records waiting for group commit
+type appendRequest struct {
+	records []*api.Record
+	// replicated records keep their offsets and timestamps
+	replicated  bool
+	first, last uint64
+	err         error
+	done        chan struct{}
+}
+
+// Append queues the record for group commit and returns once
+// the batch it's committed in holds the configured sync guarantee
 func (r *recorder) Append(record *api.Record) (uint64, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	off, err := r.activeSegment.Append(record)
+	off, _, err := r.AppendBatch([]*api.Record{record})
+	return off, err
+}
+
+// AppendBatch appends records atomically, either all or none of the records are
+// appended, and returns the contiguous offset range assigned to the records.
+// Atomicity doesn't hold across crashes: records are written one at a time,
+// a batch interrupted by a crash may be recovered as a prefix of its records.
+func (r *recorder) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	if r.Config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	return r.enqueue(&appendRequest{
+		records: records,
+		done:    make(chan struct{}),
+	})
+}
+
+// AppendReplicated appends leader records atomically as AppendBatch, keeping their
+// offsets and timestamps. Offsets increase from the next offset, skipped offsets are
+// kept as gaps, as in compacted segments.
+func (r *recorder) AppendReplicated(records []*api.Record) (first, last uint64, err error) {
+	if r.Config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	return r.enqueue(&appendRequest{
+		records:    records,
+		replicated: true,
+		done:       make(chan struct{}),
+	})
+}
+
+// enqueue queues the append request for group commit, returning once it's committed
+func (r *recorder) enqueue(req *appendRequest) (first, last uint64, err error) {
+	r.qmu.Lock()
+	r.queue = append(r.queue, req)
+	leader := !r.committing
+	r.committing = true
+	r.qmu.Unlock()
+
+	// first appender commits queued batches until the queue drains
+	if leader {
+		r.commit()
+	}
+	<-req.done
+	return req.first, req.last, req.err
+}
+
+// commit writes queued append requests in batches,
+// with one filer write and at most one sync per batch
+func (r *recorder) commit() {
+	for {
+		r.qmu.Lock()
+		batch := r.queue
+		r.queue = nil
+		if len(batch) == 0 {
+			r.committing = false
+			r.qmu.Unlock()
+			return
+		}
+		r.qmu.Unlock()
+
+		r.mu.Lock()
+		if r.done == nil {
+			// closed recorder's directory may already be locked by another writer
+			for _, req := range batch {
+				req.err = ErrRecorderClosed
+			}
+		} else {
+			r.commitBatch(batch)
+			close(r.appended)
+			r.appended = make(chan struct{})
+		}
+		r.mu.Unlock()
+
+		for _, req := range batch {
+			close(req.done)
+		}
+	}
+}
+
+func (r *recorder) commitBatch(batch []*appendRequest) {
+	for _, req := range batch {
+		req.first, req.last, req.err = r.append(req.records, req.replicated)
+	}
+
+	err := r.activeSegment.Flush()
+	if err == nil && r.shouldSync() {
+		err = r.sync()
+	}
 	if err != nil {
-		log.Printf("recorder.Append() - error appending record, offset: %d, error: %v", off, err)
-		return 0, err
+		log.Printf("recorder.commitBatch() - error committing batch, requests: %d, error: %v", len(batch), err)
+		// appended records are discarded, from the first appended request on
+		discarded := false
+		for _, req := range batch {
+			if req.err != nil {
+				continue
+			}
+			if !discarded {
+				if rerr := r.rollback(req.first); rerr != nil {
+					log.Printf("recorder.commitBatch() - error discarding records, offset: %d, error: %v", req.first, rerr)
+				}
+				discarded = true
+			}
+			req.first, req.last, req.err = 0, 0, err
+		}
 	}
-	log.Printf("recorder.Append() - appended record, offset: %d", off)
-	if r.activeSegment.IsMaxed() {
-		err = r.newSegmenter(off + 1)
+}
+
+// append writes records across as many segments as needed,
+// discarding written records if any of them fails to append
+func (r *recorder) append(records []*api.Record, replicated bool) (first, last uint64, err error) {
+	next := r.activeSegment.NextOffset()
+	var appended bool
+	for len(records) > 0 {
+		if r.activeSegment.IsMaxed() || !r.activeSegment.Fits(records[0]) {
+			if err = r.newSegmenter(r.activeSegment.NextOffset()); err != nil {
+				break
+			}
+		}
+		var f, l uint64
+		var n int
+		if replicated {
+			f, l, n, err = r.activeSegment.AppendReplicated(records)
+		} else {
+			f, l, n, err = r.activeSegment.AppendBatch(records)
+		}
+		if err != nil {
+			break
+		}
+		log.Printf("recorder.append() - appended records, offsets: %d - %d", f, l)
+		// replicated records may start past an offset gap
+		if !appended {
+			first, appended = f, true
+		}
+		r.unsynced += uint64(n)
+		records = records[n:]
+		last = l
+	}
+	if err == nil && r.activeSegment.IsMaxed() {
+		err = r.newSegmenter(last + 1)
 	}
 	if err != nil {
-		log.Printf("recorder.Append() - error appending record, offset: %d, error: %v", off, err)
+		log.Printf("recorder.append() - error appending records, offset: %d, error: %v", next, err)
+		if rerr := r.rollback(next); rerr != nil {
+			log.Printf("recorder.append() - error discarding records, offset: %d, error: %v", next, rerr)
+		}
+		return 0, 0, err
 	}
-	return off, err
+	return first, last, nil
+}
+
+// rollback discards records from offset next onwards,
+// removing segments created after next
+func (r *recorder) rollback(next uint64) error {
+	r.discards++
+	n := len(r.segments)
+	for n > 0 && r.segments[n-1].BaseOffset() > next {
+		if err := r.segments[n-1].Remove(); err != nil {
+			return err
+		}
+		n--
+	}
+	if n < len(r.segments) {
+		r.segments = r.segments[:n]
+		if err := r.syncDir(); err != nil {
+			return err
+		}
+	}
+
+	// segment holding next was removed by retention
+	if n == 0 {
+		r.activeSegment = nil
+		return r.newSegmenter(next)
+	}
+	r.activeSegment = r.segments[n-1]
+	return r.activeSegment.TruncateFrom(next)
+}
+
+// shouldSync checks if appended records need syncing per durability policy
+func (r *recorder) shouldSync() bool {
+	d := r.Config.Durability
+	switch d.Policy {
+	case SYNC_ALWAYS:
+		return true
+	case SYNC_BATCH:
+		return (d.MaxRecords > 0 && r.unsynced >= d.MaxRecords) ||
+			(d.MaxInterval > 0 && time.Since(r.lastSync) >= d.MaxInterval)
+	}
+	return false
+}
+
+// Sync commits all appended records to stable storage
+func (r *recorder) Sync() error {
+	if r.Config.ReadOnly {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		return ErrRecorderClosed
+	}
+	return r.sync()
+}
+
+func (r *recorder) sync() error {
+	if err := r.activeSegment.Sync(); err != nil {
+		log.Printf("recorder.sync() - error syncing active segment, error: %v", err)
+		return err
+	}
+	r.unsynced = 0
+	r.lastSync = time.Now()
+	return nil
 }
 
 func (r *recorder) Read(off uint64) (*api.Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	var s Segmenter
 	log.Printf("recorder.Read() - read offset: %d, has segments: %d", off, len(r.segments))
-	for _, segment := range r.segments {
-		if segment.BaseOffset() <= off && off < segment.NextOffset() {
-			s = segment
+	_, s := r.segment(off)
+	if s == nil {
+		log.Printf("recorder.Read() - nil segment or out of bounds ofset, segments: %d", len(r.segments))
+		return nil, &OffsetOutOfRangeError{Offset: off}
+	}
+	log.Printf("recorder.Read() - read segment's base offset: %d, nextOffset: %d", s.BaseOffset(), s.NextOffset())
+	record, err := s.Read(off)
+	// offset dropped by compaction, at the end of a segment truncated within a gap
+	if err == io.EOF {
+		log.Printf("recorder.Read() - record not found, offset: %d, segment next offset: %d", off, s.NextOffset())
+		return nil, &RecordNotFoundError{Offset: off}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// offset dropped by compaction
+	if record.Offset != off {
+		log.Printf("recorder.Read() - record not found, offset: %d, next offset: %d", off, record.Offset)
+		return nil, &RecordNotFoundError{Offset: off}
+	}
+	return record, nil
+}
+
+// ReadRange reads records with offsets from through to, stopping early
+// once the read records exceed Config.Read.MaxBytes
+func (r *recorder) ReadRange(from, to uint64) ([]*api.Record, error) {
+	if to < from {
+		return nil, &OffsetOutOfRangeError{Offset: to}
+	}
+
+	var records []*api.Record
+	var size uint64
+	it := r.Iterator(from, to)
+	for it.Next() {
+		records = append(records, it.Record())
+		size += uint64(proto.Size(it.Record()))
+		if r.Config.Read.MaxBytes > 0 && size >= r.Config.Read.MaxBytes {
 			break
 		}
 	}
-	if s == nil || s.NextOffset() <= off {
-		log.Printf("recorder.Read() - nil segment or out of bounds ofset, segmenter: %v, segments: %d", s, len(r.segments))
-		return nil, errors.NewAppError(ERROR_OFFSET_OUT_OF_RANGE, off)
+	if err := it.Err(); err != nil {
+		log.Printf("recorder.ReadRange() - error reading range, from: %d, to: %d, error: %v", from, to, err)
+		return nil, err
 	}
-	log.Printf("recorder.Read() - read segment's base offset: %d, nextOffset: %d", s.BaseOffset(), s.NextOffset())
-	return s.Read(off)
+	if len(records) == 0 {
+		return nil, &OffsetOutOfRangeError{Offset: from}
+	}
+	return records, nil
+}
+
+// Iterator returns an iterator over records with offsets from through to
+func (r *recorder) Iterator(from, to uint64) Iterator {
+	return &iterator{
+		r:    r,
+		next: from,
+		to:   to,
+	}
+}
+
+// segment returns the segment holding offset off, and its position in segments
+func (r *recorder) segment(off uint64) (int, Segmenter) {
+	i, s := r.segmentFrom(off)
+	if s != nil && s.BaseOffset() <= off {
+		return i, s
+	}
+	return -1, nil
+}
+
+// segmentFrom returns the first segment with offsets at or after off,
+// skipping offset gaps between segments
+func (r *recorder) segmentFrom(off uint64) (int, Segmenter) {
+	i := sort.Search(len(r.segments), func(i int) bool {
+		return r.segments[i].NextOffset() > off
+	})
+	if i < len(r.segments) {
+		return i, r.segments[i]
+	}
+	return -1, nil
 }
 
-func (r *recorder) Close() error {
+func (r *recorder) Close() (err error) {
+	log.Printf("recorder.Close() - closing recorder")
+	r.mu.Lock()
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	r.mu.Unlock()
+	// background work in progress finishes before segments are closed and the directory unlocked
+	r.wg.Wait()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	log.Printf("recorder.Close() - closing recorder")
+	// directory is unlocked whatever the close result
+	defer func() {
+		if uerr := r.unlock(); err == nil {
+			err = uerr
+		}
+	}()
+	if r.unsynced > 0 {
+		if err := r.sync(); err != nil {
+			log.Printf("recorder.Close() - error syncing recorder, err: %v", err)
+			return err
+		}
+	}
 	for _, segment := range r.segments {
-		if !segment.Closed() {
-			if err := segment.Close(); err != nil {
-				log.Printf("recorder.Close() - error closing recorder, err: %v", err)
-				return err
-			}
+		if err := segment.Close(); err != nil {
+			log.Printf("recorder.Close() - error closing recorder, err: %v", err)
+			return err
 		}
 	}
 	return nil
 }
 
+// unlock releases the directory lock
+func (r *recorder) unlock() error {
+	if r.lock == nil {
+		return nil
+	}
+	err := r.lock.Close()
+	r.lock = nil
+	if err != nil {
+		log.Printf("recorder.unlock() - error unlocking directory %s, err: %v", r.Dir, err)
+	}
+	return err
+}
+
 func (r *recorder) Remove() error {
+	if r.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := r.Close(); err != nil {
 		log.Printf("recorder.Remove() - error removing recorder")
 		return err
 	}
-	return os.RemoveAll(r.Dir)
+	return r.Config.fs().RemoveAll(r.Dir)
 }
 
 func (r *recorder) Directory() string {
@@ -175,6 +863,9 @@ func (r *recorder) Configuration() Config {
 }
 
 func (r *recorder) Reset() error {
+	if r.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := r.Remove(); err != nil {
 		log.Printf("recorder.Reset() - error resetting recorder")
 		return err
@@ -188,6 +879,45 @@ func (r *recorder) LowestOffset() (uint64, error) {
 	return r.segments[0].BaseOffset(), nil
 }
 
+// OffsetForTime returns the offset of the first record appended at or after t,
+// or the next offset if every record is older
+func (r *recorder) OffsetForTime(t time.Time) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// segments are appended in time order, empty segments are skipped over
+	ts := t.UnixNano()
+	i := sort.Search(len(r.segments), func(i int) bool {
+		s := r.segments[i]
+		if s.NextOffset() == s.BaseOffset() {
+			return true
+		}
+		_, err := s.OffsetForTime(ts)
+		return err == nil
+	})
+	for ; i < len(r.segments); i++ {
+		if off, err := r.segments[i].OffsetForTime(ts); err == nil {
+			return off, nil
+		}
+	}
+	return r.activeSegment.NextOffset(), nil
+}
+
+// DiskSize returns the total bytes of segment files
+func (r *recorder) DiskSize() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.diskSize()
+}
+
+func (r *recorder) diskSize() uint64 {
+	var size uint64
+	for _, s := range r.segments {
+		size += s.Size()
+	}
+	return size
+}
+
 func (r *recorder) HighestOffset() (uint64, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -198,9 +928,23 @@ func (r *recorder) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// NextOffset returns the offset assigned to the next appended record,
+// the lowest offset of an empty log
+func (r *recorder) NextOffset() (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.activeSegment.NextOffset(), nil
+}
+
 func (r *recorder) Truncate(lowest uint64) error {
+	if r.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.done == nil {
+		return ErrRecorderClosed
+	}
 	var segments []Segmenter
 	for _, s := range r.segments {
 		if s.NextOffset() <= lowest+1 {
@@ -212,7 +956,59 @@ func (r *recorder) Truncate(lowest uint64) error {
 		}
 		segments = append(segments, s)
 	}
+	removed := len(segments) < len(r.segments)
 	r.segments = segments
+	if removed {
+		if err := r.syncDir(); err != nil {
+			return err
+		}
+	}
+
+	// truncated active segment is replaced by an empty one,
+	// the removed active segment is neither synced nor compressed
+	if len(r.segments) == 0 {
+		next := r.activeSegment.NextOffset()
+		r.activeSegment = nil
+		return r.newSegmenter(next)
+	}
+	return nil
+}
+
+// TruncateAfter discards records after offset off, removing later segments and
+// cutting the segment holding off, so that next appends reuse discarded offsets
+func (r *recorder) TruncateAfter(off uint64) error {
+	if r.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil {
+		return ErrRecorderClosed
+	}
+
+	r.discards++
+	i := len(r.segments) - 1
+	for ; i > 0 && r.segments[i].BaseOffset() > off; i-- {
+		if err := r.segments[i].Remove(); err != nil {
+			log.Printf("recorder.TruncateAfter() - error removing segment, offset: %d, error: %v", r.segments[i].BaseOffset(), err)
+			return err
+		}
+	}
+	removed := i < len(r.segments)-1
+	r.segments = r.segments[:i+1]
+	r.activeSegment = r.segments[i]
+	// removed segments don't reappear after a crash, over reused offsets
+	if removed {
+		if err := r.syncDir(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.activeSegment.TruncateFrom(off + 1); err != nil {
+		log.Printf("recorder.TruncateAfter() - error truncating segment, offset: %d, error: %v", off, err)
+		return err
+	}
+	log.Printf("recorder.TruncateAfter() - truncated recorder, offset: %d, next offset: %d", off, r.activeSegment.NextOffset())
 	return nil
 }
 
@@ -3,10 +3,17 @@ package recorder
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	api "github.com/comfforts/recorder/api/v1"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 )
@@ -20,6 +27,10 @@ func TestRecorder(t *testing.T) {
 		"init with existing segments":       testInitExistingRecorder,
 		"reader":                            testReaderRecorder,
 		"truncate":                          testTruncateRecorder,
+		"recover unclosed recorder":         testRecoverUnclosedRecorder,
+		"append batch":                      testAppendBatchRecorder,
+		"append batch rollback":             testAppendBatchRollbackRecorder,
+		"truncate after":                    testTruncateAfterRecorder,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
@@ -55,7 +66,14 @@ func testAppendReadRecorder(t *testing.T, recorder Recorder) {
 func testOutOfRangeErrRecorder(t *testing.T, recorder Recorder) {
 	read, err := recorder.Read(1)
 	require.Nil(t, read)
-	t.Logf("error: %v", err)
+	var rerr *OffsetOutOfRangeError
+	require.ErrorAs(t, err, &rerr)
+	require.Equal(t, uint64(1), rerr.Offset)
+
+	// empty log's next offset is its lowest offset
+	next, err := recorder.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), next)
 }
 
 func testInitExistingRecorder(t *testing.T, recorder Recorder) {
@@ -99,7 +117,7 @@ func testReaderRecorder(t *testing.T, recorder Recorder) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[RECORD_LENGTH_WIDTH:], read)
+	err = proto.Unmarshal(b[FRAME_HEADER_WIDTH:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -119,3 +137,1041 @@ func testTruncateRecorder(t *testing.T, recorder Recorder) {
 	_, err = recorder.Read(0)
 	require.Error(t, err)
 }
+
+func testRecoverUnclosedRecorder(t *testing.T, recorder Recorder) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := recorder.Append(append)
+		require.NoError(t, err)
+	}
+
+	// recorder is never closed, as after a process crash
+	releaseLock(recorder)
+	n, err := NewRecorder(recorder.Directory(), recorder.Configuration())
+	require.NoError(t, err)
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	for i := uint64(0); i < 5; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, append.Value, read.Value)
+	}
+
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, n.Close())
+}
+
+func testAppendBatchRecorder(t *testing.T, recorder Recorder) {
+	_, _, err := recorder.AppendBatch(nil)
+	require.Equal(t, ErrEmptyBatch, err)
+
+	off, err := recorder.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	records := []*api.Record{}
+	for i := 1; i < 8; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+
+	// batch rolls across segments
+	first, last, err := recorder.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(7), last)
+
+	for off := first; off <= last; off++ {
+		read, err := recorder.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+	}
+	off, err = recorder.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+
+	// a record repeated in a batch is appended once per occurrence
+	record := &api.Record{Value: []byte("repeated")}
+	first, last, err = recorder.AppendBatch([]*api.Record{record, record, record})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), first)
+	require.Equal(t, uint64(10), last)
+	off, err = recorder.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	off, err = recorder.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), off)
+}
+
+func testAppendBatchRollbackRecorder(t *testing.T, recorder Recorder) {
+	off, err := recorder.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// segment at offset 6 can't be created
+	err = os.Mkdir(fmt.Sprintf("%s%d.filer", recorder.Directory(), 6), 0755)
+	require.NoError(t, err)
+
+	records := []*api.Record{}
+	for i := 1; i < 8; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	_, _, err = recorder.AppendBatch(records)
+	require.Error(t, err)
+
+	// none of the batch records are visible
+	off, err = recorder.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, err = recorder.Read(1)
+	require.Error(t, err)
+	_, err = os.Stat(fmt.Sprintf("%s%d.filer", recorder.Directory(), 3))
+	require.True(t, os.IsNotExist(err))
+
+	first, last, err := recorder.AppendBatch(records[:3])
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+	read, err := recorder.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "record 3", string(read.Value))
+}
+
+func testTruncateAfterRecorder(t *testing.T, recorder Recorder) {
+	for i := 0; i < 8; i++ {
+		_, err := recorder.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// cuts the sealed segment holding offset, removing later segments
+	err := recorder.TruncateAfter(4)
+	require.NoError(t, err)
+	off, err := recorder.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = recorder.Read(5)
+	require.Error(t, err)
+	_, err = os.Stat(fmt.Sprintf("%s%d.filer", recorder.Directory(), 6))
+	require.True(t, os.IsNotExist(err))
+
+	// discarded offsets are reused
+	for i := 5; i < 7; i++ {
+		off, err = recorder.Append(&api.Record{Value: []byte(fmt.Sprintf("new record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	// cuts the active segment
+	err = recorder.TruncateAfter(5)
+	require.NoError(t, err)
+	off, err = recorder.Append(&api.Record{Value: []byte("new record 6")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	require.NoError(t, recorder.Close())
+
+	n, err := NewRecorder(recorder.Directory(), recorder.Configuration())
+	require.NoError(t, err)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	for i := uint64(0); i < 7; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		want := fmt.Sprintf("record %d", i)
+		if i > 4 {
+			want = fmt.Sprintf("new record %d", i)
+		}
+		require.Equal(t, want, string(read.Value))
+	}
+	require.NoError(t, n.Close())
+}
+
+func TestRecorderDurability(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		policy      SyncPolicy
+		maxRecords  uint64
+		maxInterval time.Duration
+		unsynced    []uint64
+	}{
+		"os managed":        {policy: SYNC_OS, unsynced: []uint64{1, 2, 3, 4, 5}},
+		"every append":      {policy: SYNC_ALWAYS, unsynced: []uint64{0, 0, 0, 0, 0}},
+		"every two records": {policy: SYNC_BATCH, maxRecords: 2, unsynced: []uint64{1, 0, 1, 0, 1}},
+		"every interval":    {policy: SYNC_BATCH, maxInterval: time.Hour, unsynced: []uint64{1, 2, 3, 4, 5}},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+			err := createDirectory(dir)
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexSize = 10
+			c.Durability.Policy = tc.policy
+			c.Durability.MaxRecords = tc.maxRecords
+			c.Durability.MaxInterval = tc.maxInterval
+			r, err := NewRecorder(dir, c)
+			require.NoError(t, err)
+
+			for _, want := range tc.unsynced {
+				_, err = r.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				require.Equal(t, want, r.unsynced)
+			}
+
+			err = r.Sync()
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), r.unsynced)
+
+			err = r.Close()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRecorderIntervalSyncer(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+	c.Durability.Policy = SYNC_BATCH
+	c.Durability.MaxInterval = 10 * time.Millisecond
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	_, err = r.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// idle recorder is synced in the background
+	require.Eventually(t, func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.unsynced == 0
+	}, time.Second, 5*time.Millisecond)
+
+	err = r.Close()
+	require.NoError(t, err)
+}
+
+func TestRecorderGroupCommit(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+	c.Durability.Policy = SYNC_ALWAYS
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	appenders, appends := 8, 25
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	values := map[uint64]string{}
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				value := fmt.Sprintf("appender %d record %d", i, j)
+				off, err := r.Append(&api.Record{Value: []byte(value)})
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				values[off] = value
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, appenders*appends, len(values))
+	require.Equal(t, uint64(0), r.unsynced)
+	for off, value := range values {
+		read, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, value, string(read.Value))
+	}
+	off, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(appenders*appends-1), off)
+
+	err = r.Close()
+	require.NoError(t, err)
+}
+
+func BenchmarkRecorderAppend(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for scenario, parallel := range map[string]bool{
+		"serial":       false,
+		"group commit": true,
+	} {
+		b.Run(scenario, func(b *testing.B) {
+			dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+			err := createDirectory(dir)
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexSize = 1024
+			c.Durability.Policy = SYNC_ALWAYS
+			r, err := NewRecorder(dir, c)
+			require.NoError(b, err)
+			defer r.Close()
+
+			value := []byte("hello world")
+			b.ResetTimer()
+			if !parallel {
+				for i := 0; i < b.N; i++ {
+					_, err := r.Append(&api.Record{Value: value})
+					require.NoError(b, err)
+				}
+				return
+			}
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := r.Append(&api.Record{Value: value}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRecorderRetention(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := Config{Clock: clock}
+	c.Segment.MaxIndexSize = 2
+	c.Retention.MaxAge = 90 * time.Minute
+	c.Retention.CheckInterval = time.Minute
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+
+	appendRecords := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := r.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	advance := func(d time.Duration) {
+		// janitor must be waiting on the clock before time moves
+		require.Eventually(t, func() bool {
+			return clock.waiters() > 0
+		}, time.Second, time.Millisecond)
+		clock.Advance(d)
+	}
+
+	// segments [0, 1] and [2, 3] are sealed an hour apart, [4] is active
+	appendRecords(2)
+	clock.Advance(time.Hour)
+	appendRecords(3)
+
+	// first segment expires, second is still retained
+	advance(31 * time.Minute)
+	require.Eventually(t, func() bool {
+		lowest, err := r.LowestOffset()
+		return err == nil && lowest == 2
+	}, time.Second, time.Millisecond)
+
+	// second segment expires, active segment is never removed
+	advance(time.Hour)
+	require.Eventually(t, func() bool {
+		lowest, err := r.LowestOffset()
+		return err == nil && lowest == 4
+	}, time.Second, time.Millisecond)
+
+	advance(time.Hour)
+	advance(time.Minute)
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	_, err = r.Read(4)
+	require.NoError(t, err)
+	_, err = r.Read(2)
+	require.Error(t, err)
+}
+
+// fakeClock is a Clock moved forward by tests
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves clock forward by d, firing due timers
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+func (c *fakeClock) waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func TestRecorderRetentionMaxBytes(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	value := []byte("hello world")
+	recordSize := frameSize(&api.Record{Value: value}, 1, time.Now().UnixNano()) + ENTRY_WIDTH + TIME_ENTRY_WIDTH
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 2
+	c.Retention.MaxBytes = 5 * recordSize
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := r.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+		require.LessOrEqual(t, r.DiskSize(), c.Retention.MaxBytes+2*recordSize)
+	}
+
+	// two sealed segments fit within max bytes, besides the empty active segment
+	require.Equal(t, 4*recordSize, r.DiskSize())
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	for off := uint64(6); off < 10; off++ {
+		_, err = r.Read(off)
+		require.NoError(t, err)
+	}
+	_, err = r.Read(5)
+	require.Error(t, err)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	// files of three segments and the lock file
+	require.Equal(t, 10, len(files))
+}
+
+func TestRecorderRollsByStoreBytes(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	small := []byte("hello world")
+	large := make([]byte, 256)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 100
+	c.Segment.MaxStoreBytes = 3 * frameSize(&api.Record{Value: small}, 1, time.Now().UnixNano())
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, _, err = r.AppendBatch([]*api.Record{{Value: small}, {Value: small}})
+	require.NoError(t, err)
+
+	// oversized record gets its own segment
+	off, err := r.Append(&api.Record{Value: large})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = r.Append(&api.Record{Value: small})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	r.mu.RLock()
+	bases := []uint64{}
+	for _, s := range r.segments {
+		bases = append(bases, s.BaseOffset())
+	}
+	r.mu.RUnlock()
+	require.Equal(t, []uint64{0, 2, 3}, bases)
+
+	for off := uint64(0); off < 4; off++ {
+		_, err = r.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+func TestRecorderMmapIndex(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	c.Segment.IndexFormat = INDEX_MMAP
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	err = r.Close()
+	require.NoError(t, err)
+
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := 0; i < 10; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	off, err := r.Append(&api.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	// unclosed empty segment leaves a preallocated zeroed index, rebuilt on open
+	emptyDir := fmt.Sprintf("%s/empty/", TEST_DATA_DIR)
+	err = createDirectory(emptyDir)
+	require.NoError(t, err)
+	ur, err := NewRecorder(emptyDir, c)
+	require.NoError(t, err)
+	releaseLock(ur)
+	er, err := NewRecorder(emptyDir, c)
+	require.NoError(t, err)
+	defer er.Close()
+	off, err = er.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestRecorderOffsetForTime(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	c := Config{Clock: clock}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	// a record every minute, offset i at start + i minutes
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		_, err = r.Append(record)
+		require.NoError(t, err)
+		require.Equal(t, start.Add(time.Duration(i)*time.Minute).UnixNano(), record.Timestamp)
+		clock.Advance(time.Minute)
+	}
+
+	requireOffsets := func(r Recorder) {
+		for at, want := range map[time.Duration]uint64{
+			-time.Hour:                      0,
+			0:                               0,
+			time.Second:                     1,
+			4 * time.Minute:                 4,
+			5*time.Minute - time.Nanosecond: 5,
+			9 * time.Minute:                 9,
+			// newer than every record
+			time.Hour: 10,
+		} {
+			off, err := r.OffsetForTime(start.Add(at))
+			require.NoError(t, err)
+			require.Equal(t, want, off, "time %v", at)
+		}
+	}
+	requireOffsets(r)
+	err = r.Close()
+	require.NoError(t, err)
+
+	// time index is rebuilt from records when missing
+	err = os.Remove(path.Join(dir, fmt.Sprintf("3%s", TIME_INDEX_EXT)))
+	require.NoError(t, err)
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	requireOffsets(r)
+}
+
+func TestRecorderCompression(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// uncompressed segments written before compression is enabled
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	err = r.Close()
+	require.NoError(t, err)
+
+	c.Compression.Enabled = true
+	c.Compression.BlockSize = 64
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 5; i < 10; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	// sealed segments are compressed in the background, active segment isn't
+	r.wg.Wait()
+	r.mu.RLock()
+	for _, s := range r.segments {
+		_, zerr := os.Stat(path.Join(dir, fmt.Sprintf("%d%s", s.BaseOffset(), ZFILER_EXT)))
+		_, ferr := os.Stat(path.Join(dir, fmt.Sprintf("%d%s", s.BaseOffset(), FILER_EXT)))
+		if s == r.activeSegment {
+			require.True(t, os.IsNotExist(zerr))
+			require.NoError(t, ferr)
+		} else {
+			require.NoError(t, zerr)
+			require.True(t, os.IsNotExist(ferr))
+		}
+	}
+	r.mu.RUnlock()
+
+	for i := 0; i < 10; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	b, err := io.ReadAll(r.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	err = r.Close()
+	require.NoError(t, err)
+
+	// mixed compressed and uncompressed segments are read without compression
+	c.Compression.Enabled = false
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := 0; i < 10; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	readers := r.Reader()
+	rb, err := io.ReadAll(readers)
+	require.NoError(t, err)
+	require.Equal(t, b, rb)
+
+	// truncating into a compressed segment decompresses it for appends
+	err = r.TruncateAfter(4)
+	require.NoError(t, err)
+	off, err := r.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	_, err = os.Stat(path.Join(dir, fmt.Sprintf("%d%s", 3, FILER_EXT)))
+	require.NoError(t, err)
+}
+
+func TestRecorderCompressionInBackground(t *testing.T) {
+	dir := "mem-data"
+	compressing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fsys := &hookFS{FS: NewMemFS(), open: func(name string) {
+		if strings.HasSuffix(name, ZFILER_EXT+TMP_EXT) {
+			once.Do(func() {
+				close(compressing)
+				<-release
+			})
+		}
+	}}
+
+	c := Config{FS: fsys}
+	c.Segment.MaxIndexSize = 3
+	c.Compression.Enabled = true
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// appends and reads go on while the sealed segment is compressed
+	<-compressing
+	for i := 3; i < 5; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	record, err := r.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), record.Value)
+	close(release)
+
+	r.wg.Wait()
+	_, err = fsys.Stat(path.Join(dir, fmt.Sprintf("0%s", ZFILER_EXT)))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	require.NoError(t, r.Close())
+}
+
+func TestRecorderCompressionTruncated(t *testing.T) {
+	dir := "mem-data"
+	fsys := &hookFS{FS: NewMemFS(), open: func(name string) {}}
+	c := Config{FS: fsys}
+	c.Segment.MaxIndexSize = 3
+	c.Compression.Enabled = true
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	appendValues(t, r, 0, 9)
+	r.wg.Wait()
+
+	// segments removed by truncation aren't compressed
+	var compressed []string
+	fsys.open = func(name string) {
+		if strings.HasSuffix(name, ZFILER_EXT+TMP_EXT) {
+			compressed = append(compressed, name)
+		}
+	}
+	err = r.Truncate(8)
+	require.NoError(t, err)
+	r.wg.Wait()
+	require.Empty(t, compressed)
+
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), lowest)
+	off, err := r.Append(&api.Record{Value: []byte("record 9")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+}
+
+func TestRecorderEncryption(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// unencrypted segment written before encryption is enabled
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	_, err = r.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+	err = r.Close()
+	require.NoError(t, err)
+
+	c.Encryption.KeyProvider = NewKeyRing("key-1", TEST_KEYS)
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 1; i < 5; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	err = r.Close()
+	require.NoError(t, err)
+
+	// rotated key encrypts new segments
+	c.Encryption.KeyProvider = NewKeyRing("key-2", TEST_KEYS)
+	c.Compression.Enabled = true
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 5; i < 10; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	r.mu.RLock()
+	keys := map[uint64]string{}
+	for _, s := range r.segments {
+		if f, ok := s.Filer().(*cryptFiler); ok {
+			keys[s.BaseOffset()] = f.keyID
+		}
+	}
+	r.mu.RUnlock()
+	// unencrypted segment takes no more records once encryption is enabled
+	require.Equal(t, map[uint64]string{1: "key-1", 4: "key-1", 7: "key-2", 10: "key-2"}, keys)
+
+	for i := 0; i < 10; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	err = r.Close()
+	require.NoError(t, err)
+
+	// segments encrypted with a retired key aren't opened
+	c.Encryption.KeyProvider = NewKeyRing("key-2", map[string][]byte{"key-2": TEST_KEYS["key-2"]})
+	_, err = NewRecorder(dir, c)
+	require.Error(t, err)
+}
+
+func TestRecorderMemFS(t *testing.T) {
+	dir := "mem-data"
+	fsys := NewMemFS()
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	c.FS = fsys
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		off, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	err = r.Close()
+	require.NoError(t, err)
+
+	// nothing is written to disk
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	err = r.Remove()
+	require.NoError(t, err)
+	entries, err := fsys.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestRecorderFaults(t *testing.T) {
+	dir := "mem-data"
+	mfs := NewMemFS()
+	fsys := NewFaultFS(mfs)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 100
+	c.Durability.Policy = SYNC_ALWAYS
+	c.FS = fsys
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// failed sync fails the append, records are discarded
+	fsys.Inject(Fault{Op: FAULT_SYNC, Path: FILER_EXT})
+	_, err = r.Append(&api.Record{Value: []byte("failed")})
+	require.Error(t, err)
+	fsys.Clear()
+	_, err = r.Read(3)
+	require.Error(t, err)
+	off, err := r.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// short write tears the record, append fails and the record is discarded
+	fsys.Inject(Fault{Op: FAULT_WRITE, Path: FILER_EXT, Short: 5, Err: syscall.ENOSPC})
+	_, _, err = r.AppendBatch([]*api.Record{{Value: []byte("failed")}, {Value: []byte("failed")}})
+	require.Error(t, err)
+	fsys.Clear()
+	_, err = r.Read(4)
+	require.Error(t, err)
+	off, err = r.Append(&api.Record{Value: []byte("record 4")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	record, err := r.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+
+	// failed close still releases the directory lock
+	fsys.Inject(Fault{Op: FAULT_SYNC, Path: FILER_EXT})
+	_, err = r.Append(&api.Record{Value: []byte("failed")})
+	require.Error(t, err)
+	require.Error(t, r.Close())
+	fsys.Clear()
+
+	// acknowledged records are read on reopen
+	c.FS = mfs
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	defer r.Remove()
+	for i := 0; i < 5; i++ {
+		record, err := r.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+	}
+	off, err = r.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+// releaseLock releases the recorder's directory lock, as on process exit
+func releaseLock(r Recorder) {
+	r.(*recorder).unlock()
+}
+
+func TestRecorderLock(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	_, err = r.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+
+	// locked by the writer
+	_, err = NewRecorder(dir, c)
+	require.Error(t, err)
+	_, ok := err.(*LogInUseError)
+	require.True(t, ok)
+	ro := c
+	ro.ReadOnly = true
+	_, err = NewRecorder(dir, ro)
+	_, ok = err.(*LogInUseError)
+	require.True(t, ok)
+
+	err = r.Close()
+	require.NoError(t, err)
+
+	// read only recorders share the lock, writers are locked out
+	r1, err := NewRecorder(dir, ro)
+	require.NoError(t, err)
+	r2, err := NewRecorder(dir, ro)
+	require.NoError(t, err)
+	_, err = NewRecorder(dir, c)
+	_, ok = err.(*LogInUseError)
+	require.True(t, ok)
+
+	record, err := r1.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), record.Value)
+	_, err = r1.Append(&api.Record{Value: []byte("record 1")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, r1.Truncate(0))
+	require.Equal(t, ErrReadOnly, r1.TruncateAfter(0))
+	require.Equal(t, ErrReadOnly, r1.Compact())
+	require.Equal(t, ErrReadOnly, r1.Remove())
+
+	err = r1.Close()
+	require.NoError(t, err)
+	err = r2.Close()
+	require.NoError(t, err)
+
+	// lock is released on close and remove
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	err = r.Remove()
+	require.NoError(t, err)
+	err = createDirectory(dir)
+	require.NoError(t, err)
+	r, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	err = r.Close()
+	require.NoError(t, err)
+}
+
+func TestRecorderClosed(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	_, err = r.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+	err = r.Close()
+	require.NoError(t, err)
+
+	// closed recorder leaves the directory to the next writer
+	r1, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	_, err = r.Append(&api.Record{Value: []byte("closed")})
+	require.Equal(t, ErrRecorderClosed, err)
+	off, err := r1.Append(&api.Record{Value: []byte("record 1")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = r.Append(&api.Record{Value: []byte("closed")})
+	require.Equal(t, ErrRecorderClosed, err)
+	require.Equal(t, ErrRecorderClosed, r.Truncate(0))
+	require.Equal(t, ErrRecorderClosed, r.TruncateAfter(0))
+	require.Equal(t, ErrRecorderClosed, r.Compact())
+	require.Equal(t, ErrRecorderClosed, r.Sync())
+	err = r1.Close()
+	require.NoError(t, err)
+
+	r1, err = NewRecorder(dir, c)
+	require.NoError(t, err)
+	record, err := r1.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), record.Value)
+	err = r1.Close()
+	require.NoError(t, err)
+}
@@ -0,0 +1,118 @@
+package recorder
+
+import (
+	"context"
+	"log"
+	"math"
+
+	"github.com/comfforts/errors"
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+const (
+	ERROR_REPLICA_DIVERGED string = "error replica diverged, follower offset: %d, leader offset: %d"
+)
+
+// Transport carries leader records to a follower
+type Transport interface {
+	// Fetch returns up to max leader records from offset from onwards,
+	// blocking until records are available or ctx is done
+	Fetch(ctx context.Context, from uint64, max int) ([]*api.Record, error)
+}
+
+// memoryTransport fetches records from an in process leader
+type memoryTransport struct {
+	leader Recorder
+}
+
+func NewMemoryTransport(leader Recorder) *memoryTransport {
+	return &memoryTransport{
+		leader: leader,
+	}
+}
+
+func (t *memoryTransport) Fetch(ctx context.Context, from uint64, max int) ([]*api.Record, error) {
+	if records, err := t.read(from, max); err != nil || len(records) > 0 {
+		return records, err
+	}
+
+	// wait for leader to append from offset
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := t.leader.Subscribe(sctx, from)
+	if err != nil {
+		log.Printf("memoryTransport.Fetch() - error subscribing to leader, offset: %d, error: %v", from, err)
+		return nil, err
+	}
+	if _, ok := <-sub.Records(); !ok {
+		return nil, sub.Err()
+	}
+	return t.read(from, max)
+}
+
+// read returns up to max leader records from offset from onwards, skipping offset gaps
+func (t *memoryTransport) read(from uint64, max int) ([]*api.Record, error) {
+	var records []*api.Record
+	it := t.leader.Iterator(from, math.MaxUint64)
+	for len(records) < max && it.Next() {
+		records = append(records, it.Record())
+	}
+	if err := it.Err(); err != nil {
+		log.Printf("memoryTransport.read() - error reading leader records, offset: %d, error: %v", from, err)
+		return nil, err
+	}
+	return records, nil
+}
+
+// Replicator copies leader records onto a follower,
+// keeping leader's record offsets, timestamps and terms
+type Replicator struct {
+	follower  Recorder
+	transport Transport
+	batchSize int
+}
+
+func NewReplicator(follower Recorder, t Transport, batchSize int) *Replicator {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &Replicator{
+		follower:  follower,
+		transport: t,
+		batchSize: batchSize,
+	}
+}
+
+// Replicate fetches leader records from the follower's next offset onwards
+// and appends them on the follower, until ctx is done or replication fails
+func (rp *Replicator) Replicate(ctx context.Context) error {
+	next, err := rp.follower.NextOffset()
+	if err != nil {
+		log.Printf("Replicator.Replicate() - error getting follower offset, error: %v", err)
+		return err
+	}
+	for {
+		records, err := rp.transport.Fetch(ctx, next, rp.batchSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Replicator.Replicate() - error fetching records, offset: %d, error: %v", next, err)
+			return err
+		}
+
+		// leader's offsets increase from follower's next offset, with gaps left by compaction
+		for i, record := range records {
+			if record.Offset < next || (i > 0 && record.Offset <= records[i-1].Offset) {
+				log.Printf("Replicator.Replicate() - replica diverged, follower offset: %d, leader offset: %d", next, record.Offset)
+				return errors.NewAppError(ERROR_REPLICA_DIVERGED, next, record.Offset)
+			}
+		}
+		_, last, err := rp.follower.AppendReplicated(records)
+		if err != nil {
+			log.Printf("Replicator.Replicate() - error appending records, offset: %d, error: %v", next, err)
+			return err
+		}
+		next = last + 1
+	}
+}
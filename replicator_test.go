@@ -0,0 +1,182 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+func TestReplicator(t *testing.T) {
+	leaderDir := filepath.Join(TEST_DATA_DIR, "leader") + "/"
+	followerDir := filepath.Join(TEST_DATA_DIR, "follower") + "/"
+	require.NoError(t, createDirectory(leaderDir))
+	require.NoError(t, createDirectory(followerDir))
+	defer os.RemoveAll(TEST_DATA_DIR)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	leader, err := NewRecorder(leaderDir, c)
+	require.NoError(t, err)
+	follower, err := NewRecorder(followerDir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Term: 1})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replicator := NewReplicator(follower, NewMemoryTransport(leader), 2)
+	errCh := make(chan error)
+	go func() {
+		errCh <- replicator.Replicate(ctx)
+	}()
+
+	requireReplicated := func(highest uint64) {
+		require.Eventually(t, func() bool {
+			off, err := follower.NextOffset()
+			return err == nil && off == highest+1
+		}, time.Second, 5*time.Millisecond)
+	}
+	requireReplicated(4)
+
+	// records appended after catching up are replicated
+	for i := 5; i < 8; i++ {
+		_, err = leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Term: 2})
+		require.NoError(t, err)
+	}
+	requireReplicated(7)
+
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+
+	for off := uint64(0); off < 8; off++ {
+		want, err := leader.Read(off)
+		require.NoError(t, err)
+		got, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Offset, got.Offset)
+		require.Equal(t, want.Term, got.Term)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// follower behind truncated leader stops replication
+	laggingDir := filepath.Join(TEST_DATA_DIR, "lagging") + "/"
+	require.NoError(t, createDirectory(laggingDir))
+	lagging, err := NewRecorder(laggingDir, c)
+	require.NoError(t, err)
+	err = leader.Truncate(5)
+	require.NoError(t, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = NewReplicator(lagging, NewMemoryTransport(leader), 2).Replicate(ctx)
+	require.Error(t, err)
+	require.NotEqual(t, context.DeadlineExceeded, err)
+	require.NoError(t, lagging.Close())
+
+	require.NoError(t, leader.Close())
+	require.NoError(t, follower.Close())
+}
+
+type staticTransport struct {
+	records []*api.Record
+}
+
+func (t *staticTransport) Fetch(ctx context.Context, from uint64, max int) ([]*api.Record, error) {
+	return t.records, nil
+}
+
+func TestReplicatorDiverged(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	require.NoError(t, createDirectory(dir))
+	defer os.RemoveAll(TEST_DATA_DIR)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	follower, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = follower.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// leader records behind follower's next offset
+	transport := &staticTransport{
+		records: []*api.Record{
+			{Value: []byte("record 3"), Offset: 3},
+		},
+	}
+	err = NewReplicator(follower, transport, 2).Replicate(context.Background())
+	require.Error(t, err)
+
+	// diverged records aren't appended
+	highest, err := follower.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	record, err := follower.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 3"), record.Value)
+	require.NoError(t, follower.Close())
+}
+
+func TestReplicatorCompactedLeader(t *testing.T) {
+	leaderDir := filepath.Join(TEST_DATA_DIR, "leader") + "/"
+	followerDir := filepath.Join(TEST_DATA_DIR, "follower") + "/"
+	require.NoError(t, createDirectory(leaderDir))
+	require.NoError(t, createDirectory(followerDir))
+	defer os.RemoveAll(TEST_DATA_DIR)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	leader, err := NewRecorder(leaderDir, c)
+	require.NoError(t, err)
+	defer leader.Close()
+	follower, err := NewRecorder(followerDir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	// compaction leaves offset gaps in the leader's sealed segments
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Term: 1}
+		if i%3 != 0 {
+			record.Key = []byte(fmt.Sprintf("k%d", i%3))
+		}
+		_, err = leader.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, leader.Compact())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- NewReplicator(follower, NewMemoryTransport(leader), 2).Replicate(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		off, err := follower.NextOffset()
+		return err == nil && off == 10
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+
+	// follower keeps leader's offsets and gaps
+	for off := uint64(0); off < 10; off++ {
+		want, lerr := leader.Read(off)
+		got, err := follower.Read(off)
+		if lerr != nil {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, want.Offset, got.Offset)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-protoc api/v1/*.proto --go_out=. --go_opt=paths=source_relative --proto_path=.
+protoc api/v1/*.proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative --proto_path=.
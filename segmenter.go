@@ -6,27 +6,62 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/comfforts/errors"
 	api "github.com/comfforts/recorder/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	ERROR_OPENING_FILER      string = "error opening filer %s"
-	ERROR_OPENING_INDEX      string = "error opening index %s"
-	ERROR_REMOVING_FILER     string = "error removing filer %s"
-	ERROR_REMOVING_INDEX     string = "error removing index %s"
-	ERROR_MARSHALLING_RECORD string = "error marshalling record"
+	ERROR_OPENING_FILER        string = "error opening filer %s"
+	ERROR_OPENING_INDEX        string = "error opening index %s"
+	ERROR_REMOVING_FILER       string = "error removing filer %s"
+	ERROR_REMOVING_INDEX       string = "error removing index %s"
+	ERROR_MARSHALLING_RECORD   string = "error marshalling record"
+	ERROR_UNMARSHALLING_RECORD string = "error unmarshalling record"
+	ERROR_REBUILDING_INDEX     string = "error rebuilding index %s"
+	ERROR_OPENING_TIME_INDEX   string = "error opening time index %s"
+	ERROR_REMOVING_TIME_INDEX  string = "error removing time index %s"
+	ERROR_OFFSET_BEHIND        string = "record offset %d is behind next offset %d"
+)
+
+const (
+	FILER_EXT      = ".filer"
+	ZFILER_EXT     = ".zfiler"
+	INDEX_EXT      = ".index"
+	TIME_INDEX_EXT = ".timeindex"
+	// TMP_EXT suffixes files being written before they're renamed in place
+	TMP_EXT = ".tmp"
+)
+
+// protobuf field numbers of record fields assigned on append
+const (
+	RECORD_OFFSET_FIELD    protowire.Number = 2
+	RECORD_TIMESTAMP_FIELD protowire.Number = 6
 )
 
 type Segmenter interface {
 	Append(record *api.Record) (offset uint64, err error)
+	AppendBatch(records []*api.Record) (first, last uint64, n int, err error)
+	AppendReplicated(records []*api.Record) (first, last uint64, n int, err error)
 	Read(off uint64) (*api.Record, error)
+	TruncateFrom(off uint64) error
 	BaseOffset() uint64
 	NextOffset() uint64
+	LastAppended() time.Time
+	OffsetForTime(ts int64) (uint64, error)
+	Size() uint64
 	Filer() Filer
+	Compress(blockSize uint64) error
+	UseCompressed(zPath string) error
 	IsMaxed() bool
+	Fits(record *api.Record) bool
+	Flush() error
+	Sync() error
 	Close() error
 	Remove() error
 	Closed() bool
@@ -35,118 +70,517 @@ type Segmenter interface {
 type segmenter struct {
 	filer                  Filer
 	indexer                Indexer
+	timeIndexer            TimeIndexer
 	baseOffset, nextOffset uint64
 	config                 Config
 	closed                 bool
+	// times of oldest and newest records
+	firstAppended, lastAppended time.Time
+
+	// read only filer of a closed segment, reused across reads
+	mu     sync.Mutex
+	reader Filer
 }
 
 func newSegmenter(dir string, baseOffset uint64, c Config) (*segmenter, error) {
+	return openSegmenter(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, FILER_EXT)),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, INDEX_EXT)),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, TIME_INDEX_EXT)),
+		baseOffset,
+		c,
+	)
+}
+
+// openSegmenter opens or creates segment files at given paths
+func openSegmenter(fPath, iPath, tPath string, baseOffset uint64, c Config) (*segmenter, error) {
 	s := &segmenter{
 		baseOffset: baseOffset,
 		config:     c,
 	}
 
-	fPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".filer"))
-	var filerFile *os.File
-	_, err := os.Stat(fPath)
-	if err != nil {
-		filerFile, err = os.Create(fPath)
-	} else {
-		filerFile, err = os.Open(fPath)
-		log.Printf("segmenter.newSegmenter() - opened existing filer file: %s", fPath)
-	}
-	if err != nil {
-		log.Printf("segmenter.newSegmenter() - error initializing filer file, err: %v", err)
-		return nil, errors.WrapError(err, ERROR_OPENING_FILER, fPath)
+	var err error
+	if path.Ext(fPath) == FILER_EXT {
+		zPath := compressedPath(fPath)
+		if _, err = s.config.fs().Stat(fPath); err == nil {
+			// filer left over by compression or written by compaction, over a stale compressed filer,
+			// removed by the writer
+			if c.ReadOnly {
+				err = nil
+			} else if err = s.config.fs().Remove(zPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("segmenter.newSegmenter() - error removing stale compressed filer, err: %v", err)
+				return nil, errors.WrapError(err, ERROR_REMOVING_FILER, zPath)
+			}
+		} else if _, err = s.config.fs().Stat(zPath); err == nil {
+			fPath = zPath
+		}
 	}
 
-	if s.filer, err = newFiler(filerFile); err != nil {
-		log.Printf("segmenter.newSegmenter() - error creating filer, err: %v", err)
+	var f Filer
+	if path.Ext(fPath) == ZFILER_EXT || c.ReadOnly {
+		if f, err = openReadFiler(s.config.fs(), fPath); err != nil {
+			log.Printf("segmenter.newSegmenter() - error creating compressed filer, err: %v", err)
+			return nil, err
+		}
+	} else {
+		filerFile, err := s.config.fs().OpenFile(fPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("segmenter.newSegmenter() - error initializing filer file, err: %v", err)
+			return nil, errors.WrapError(err, ERROR_OPENING_FILER, fPath)
+		}
+
+		if f, err = newFiler(filerFile); err != nil {
+			log.Printf("segmenter.newSegmenter() - error creating filer, err: %v", err)
+			return nil, err
+		}
+	}
+	// compressed filers are read only
+	if s.filer, err = cipherFiler(f, c, path.Ext(fPath) != ZFILER_EXT && !c.ReadOnly); err != nil {
+		log.Printf("segmenter.newSegmenter() - error creating encrypting filer, err: %v", err)
+		f.Close()
 		return nil, err
 	}
 
-	var indexFile *os.File
-	iPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
-	_, err = os.Stat(iPath)
-	if err != nil {
-		indexFile, err = os.Create(iPath)
-	} else {
-		indexFile, err = os.Open(iPath)
-		log.Printf("segmenter.newSegmenter() - opened existing indexer file: %s", iPath)
-	}
+	indexFile, err := s.openIndexFile(iPath)
 	if err != nil {
 		log.Printf("segmenter.newSegmenter() - error initializing indexer file, err: %v", err)
 		return nil, errors.WrapError(err, ERROR_OPENING_INDEX, iPath)
 	}
 
-	if s.indexer, err = newIndexer(indexFile, c); err != nil {
-		log.Printf("segmenter.newSegmenter() - error creating indexer, err: %v", err)
-		return nil, err
+	if s.indexer, err = openIndexer(indexFile, c); err != nil {
+		log.Printf("segmenter.newSegmenter() - error creating indexer, rebuilding index, err: %v", err)
+	}
+	if err != nil || !s.indexed() {
+		// index file is reopened, releasing the unusable indexer
+		if s.indexer != nil {
+			s.indexer.Close()
+		} else {
+			indexFile.Close()
+		}
+		if indexFile, err = s.openIndexFile(iPath); err != nil {
+			log.Printf("segmenter.newSegmenter() - error reopening indexer file, err: %v", err)
+			return nil, errors.WrapError(err, ERROR_OPENING_INDEX, iPath)
+		}
+		if err = s.rebuildIndex(indexFile); err != nil {
+			log.Printf("segmenter.newSegmenter() - error rebuilding indexer, err: %v", err)
+			return nil, err
+		}
 	}
 	log.Printf("segmenter.newSegmenter() - indexer size: %d", s.indexer.Size())
+
+	timeIndexFile, err := s.openIndexFile(tPath)
+	if err != nil {
+		log.Printf("segmenter.newSegmenter() - error initializing time indexer file, err: %v", err)
+		return nil, errors.WrapError(err, ERROR_OPENING_TIME_INDEX, tPath)
+	}
+	if s.timeIndexer, err = newTimeIndexer(timeIndexFile); err != nil {
+		log.Printf("segmenter.newSegmenter() - error creating time indexer, rebuilding time index, err: %v", err)
+	}
+	if err != nil || !s.timeIndexed() {
+		if err = s.rebuildTimeIndex(timeIndexFile); err != nil {
+			log.Printf("segmenter.newSegmenter() - error rebuilding time indexer, err: %v", err)
+			return nil, err
+		}
+	}
 	if off, _, err := s.indexer.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	// segment's age is told by its records' timestamps
+	if first, _, err := s.timeIndexer.First(); err == nil {
+		last, _, _ := s.timeIndexer.Last()
+		s.firstAppended, s.lastAppended = time.Unix(0, first), time.Unix(0, last)
+	}
 	return s, nil
 }
 
+// openIndexFile opens or creates named index file.
+// Read only segments index in memory copies of the index files.
+func (s *segmenter) openIndexFile(name string) (File, error) {
+	if s.config.ReadOnly {
+		return copyFile(s.config.fs(), name)
+	}
+	return s.config.fs().OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// indexed checks that the index covers every record in the filer
+func (s *segmenter) indexed() bool {
+	off, pos, err := s.indexer.Read(-1)
+	if err != nil {
+		return s.filer.Size() == 0
+	}
+	// last indexed record should be the last record in the filer
+	var scanned int
+	end, err := s.filer.Scan(pos, func(_ uint64, p []byte) bool {
+		if scanned++; scanned > 1 {
+			return false
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil || record.Offset != s.baseOffset+uint64(off) {
+			log.Printf("segmenter.indexed() - last indexed record mismatch, offset: %d, error: %v", off, err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("segmenter.indexed() - error reading last indexed record, error: %v", err)
+		return false
+	}
+	return scanned == 1 && end == s.filer.Size()
+}
+
+// timeIndexed checks that the time index covers every indexed record,
+// discarding time entries of records missing from the index
+func (s *segmenter) timeIndexed() bool {
+	off, _, err := s.indexer.Read(-1)
+	if err != nil {
+		return s.timeIndexer.Truncate(0) == nil
+	}
+	if err = s.timeIndexer.Truncate(off + 1); err != nil {
+		return false
+	}
+	_, last, err := s.timeIndexer.Last()
+	return err == nil && last == off
+}
+
+// rebuildTimeIndex rewrites the time index from records in the filer
+func (s *segmenter) rebuildTimeIndex(f File) error {
+	log.Printf("segmenter.rebuildTimeIndex() - rebuilding time index %s from filer %s", f.Name(), s.filer.Name())
+	if err := f.Truncate(0); err != nil {
+		log.Printf("segmenter.rebuildTimeIndex() - error truncating time index file, error: %v", err)
+		return errors.WrapError(err, ERROR_REBUILDING_INDEX, f.Name())
+	}
+	ti, err := newTimeIndexer(f)
+	if err != nil {
+		return err
+	}
+	var werr error
+	if _, err = s.filer.Scan(0, func(pos uint64, p []byte) bool {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return false
+		}
+		werr = ti.Write(record.Timestamp, uint32(record.Offset-s.baseOffset))
+		return werr == nil
+	}); err == nil {
+		err = werr
+	}
+	if err != nil {
+		log.Printf("segmenter.rebuildTimeIndex() - error scanning filer, error: %v", err)
+		return err
+	}
+	s.timeIndexer = ti
+	return nil
+}
+
+// rebuildIndex rewrites the index from records in the filer,
+// truncating a torn or unreadable trailing record
+func (s *segmenter) rebuildIndex(f File) error {
+	log.Printf("segmenter.rebuildIndex() - rebuilding index %s from filer %s", f.Name(), s.filer.Name())
+	if err := f.Truncate(0); err != nil {
+		log.Printf("segmenter.rebuildIndex() - error truncating index file, error: %v", err)
+		return errors.WrapError(err, ERROR_REBUILDING_INDEX, f.Name())
+	}
+	idx, err := openIndexer(f, s.config)
+	if err != nil {
+		log.Printf("segmenter.rebuildIndex() - error creating indexer, error: %v", err)
+		return err
+	}
+
+	var werr error
+	next := s.baseOffset
+	end, err := s.filer.Scan(0, func(pos uint64, p []byte) bool {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			log.Printf("segmenter.rebuildIndex() - error unmarshalling record, position: %d, error: %v", pos, err)
+			return false
+		}
+		// offsets increase, with gaps in compacted segments
+		if record.Offset < next {
+			log.Printf("segmenter.rebuildIndex() - unexpected record offset, position: %d, offset: %d", pos, record.Offset)
+			return false
+		}
+		if werr = idx.Write(uint32(record.Offset-s.baseOffset), pos); werr != nil {
+			return false
+		}
+		next = record.Offset + 1
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		log.Printf("segmenter.rebuildIndex() - error scanning filer, error: %v", err)
+		return err
+	}
+
+	if end < s.filer.Size() && s.config.ReadOnly {
+		// the writer may be appending the trailing record
+		log.Printf("segmenter.rebuildIndex() - skipping torn records, filer: %s, size: %d, end: %d", s.filer.Name(), s.filer.Size(), end)
+	} else if end < s.filer.Size() {
+		log.Printf("segmenter.rebuildIndex() - truncating torn records, filer: %s, size: %d, end: %d", s.filer.Name(), s.filer.Size(), end)
+		if err = s.filer.Truncate(int64(end)); err != nil {
+			return err
+		}
+	}
+	s.indexer = idx
+	log.Printf("segmenter.rebuildIndex() - rebuilt index %s, size: %d", f.Name(), idx.Size())
+	return nil
+}
+
 func (s *segmenter) Append(record *api.Record) (offset uint64, err error) {
-	if s.IsMaxed() {
+	if s.IsMaxed() || !s.Fits(record) {
 		log.Printf("segmenter.Append() - segment is maxed out, baseoffset: %d, nextoffset: %d, indexer size: %d", s.baseOffset, s.nextOffset, s.indexer.Size())
 		return 0, io.EOF
 	}
 
-	cur := s.nextOffset
-	record.Offset = cur
+	record.Offset = s.nextOffset
+	record.Timestamp = s.config.clock().Now().UnixNano()
+	if err := s.write(record); err != nil {
+		return 0, err
+	}
+	return record.Offset, nil
+}
 
+// write appends the record at its own offset, skipping offsets
+// from next offset up to the record's offset
+func (s *segmenter) write(record *api.Record) error {
 	p, err := proto.Marshal(record)
 	if err != nil {
-		log.Printf("segmenter.Append() - error marshalling record, error: %v", err)
-		return 0, errors.WrapError(err, ERROR_MARSHALLING_RECORD)
+		log.Printf("segmenter.write() - error marshalling record, error: %v", err)
+		return errors.WrapError(err, ERROR_MARSHALLING_RECORD)
 	}
 
 	_, pos, err := s.filer.Append(p)
 	if err != nil {
-		log.Printf("segmenter.Append() - error appending record to filer, error: %v", err)
-		return 0, err
+		log.Printf("segmenter.write() - error appending record to filer, error: %v", err)
+		return err
 	}
 	if err = s.indexer.Write(
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		uint32(record.Offset-s.baseOffset),
 		pos,
 	); err != nil {
-		log.Printf("segmenter.Append() - error indexing, error: %v", err)
+		log.Printf("segmenter.write() - error indexing, error: %v", err)
+		return err
+	}
+	if err = s.timeIndexer.Write(record.Timestamp, uint32(record.Offset-s.baseOffset)); err != nil {
+		log.Printf("segmenter.write() - error time indexing, error: %v", err)
+		return err
+	}
+	// compacted and replicated records keep their append time
+	at := time.Unix(0, record.Timestamp)
+	if at.Before(s.lastAppended) {
+		at = s.lastAppended
+	}
+	s.lastAppended = at
+	if s.nextOffset == s.baseOffset {
+		s.firstAppended = s.lastAppended
+	}
+	s.nextOffset = record.Offset + 1
+	return nil
+}
+
+// AppendBatch appends records until the segment is maxed, returning the offset range
+// and the number of appended records. Records are discarded if any of them fails to append.
+func (s *segmenter) AppendBatch(records []*api.Record) (first, last uint64, n int, err error) {
+	return s.appendBatch(records, s.Append)
+}
+
+// AppendReplicated appends records keeping their offsets and timestamps, as AppendBatch.
+// Record offsets increase from the next offset, skipped offsets are gaps.
+func (s *segmenter) AppendReplicated(records []*api.Record) (first, last uint64, n int, err error) {
+	return s.appendBatch(records, s.appendAt)
+}
+
+// appendAt appends the record at its own offset
+func (s *segmenter) appendAt(record *api.Record) (uint64, error) {
+	if record.Offset < s.nextOffset {
+		log.Printf("segmenter.appendAt() - record offset behind next offset, offset: %d, nextoffset: %d", record.Offset, s.nextOffset)
+		return 0, errors.NewAppError(ERROR_OFFSET_BEHIND, record.Offset, s.nextOffset)
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = s.config.clock().Now().UnixNano()
+	}
+	if err := s.write(record); err != nil {
 		return 0, err
 	}
-	s.nextOffset++
-	return cur, nil
+	return record.Offset, nil
 }
 
-func (s *segmenter) Read(off uint64) (*api.Record, error) {
+// appendBatch appends records with fn until the segment is maxed
+func (s *segmenter) appendBatch(records []*api.Record, fn func(record *api.Record) (uint64, error)) (first, last uint64, n int, err error) {
+	if s.IsMaxed() {
+		log.Printf("segmenter.AppendBatch() - segment is maxed out, baseoffset: %d, nextoffset: %d, indexer size: %d", s.baseOffset, s.nextOffset, s.indexer.Size())
+		return 0, 0, 0, io.EOF
+	}
+
+	if !s.Fits(records[0]) {
+		log.Printf("segmenter.AppendBatch() - record doesn't fit segment, baseoffset: %d, nextoffset: %d, filer size: %d", s.baseOffset, s.nextOffset, s.filer.Size())
+		return 0, 0, 0, io.EOF
+	}
+
+	next := s.nextOffset
+	for _, record := range records {
+		if s.IsMaxed() || !s.Fits(record) {
+			break
+		}
+		if last, err = fn(record); err != nil {
+			log.Printf("segmenter.AppendBatch() - error appending batch, discarding from offset: %d, error: %v", next, err)
+			if terr := s.TruncateFrom(next); terr != nil {
+				log.Printf("segmenter.AppendBatch() - error discarding batch, error: %v", terr)
+			}
+			return 0, 0, 0, err
+		}
+		if n == 0 {
+			first = last
+		}
+		n++
+	}
+	return first, last, n, nil
+}
+
+// TruncateFrom discards records from offset off onwards, reopening a closed segment
+func (s *segmenter) TruncateFrom(off uint64) error {
+	if s.closed {
+		if err := s.reopen(); err != nil {
+			log.Printf("segmenter.TruncateFrom() - error reopening segment, error: %v", err)
+			return err
+		}
+	}
+	if off >= s.nextOffset {
+		return nil
+	}
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+
+	// records are kept up to the indexed position of off, or of the next available offset
 	_, pos, err := s.indexer.Read(int64(off - s.baseOffset))
 	if err != nil {
-		log.Printf("segmenter.Read() - error reading index, error: %v", err)
-		return nil, err
+		log.Printf("segmenter.TruncateFrom() - error reading index, offset: %d, error: %v", off, err)
+		return err
+	}
+	if err = s.filer.Truncate(int64(pos)); err != nil {
+		log.Printf("segmenter.TruncateFrom() - error truncating filer, error: %v", err)
+		return err
+	}
+	if err = s.indexer.Truncate(uint32(off - s.baseOffset)); err != nil {
+		log.Printf("segmenter.TruncateFrom() - error truncating indexer, error: %v", err)
+		return err
+	}
+	if err = s.timeIndexer.Truncate(uint32(off - s.baseOffset)); err != nil {
+		log.Printf("segmenter.TruncateFrom() - error truncating time indexer, error: %v", err)
+		return err
+	}
+	log.Printf("segmenter.TruncateFrom() - truncated segment, baseoffset: %d, nextoffset: %d, truncated offset: %d", s.baseOffset, s.nextOffset, off)
+	s.nextOffset = off
+	if off == s.baseOffset {
+		s.firstAppended, s.lastAppended = time.Time{}, time.Time{}
+	}
+	// discarded records don't reappear after a crash
+	if err = s.Sync(); err != nil {
+		log.Printf("segmenter.TruncateFrom() - error syncing truncated segment, error: %v", err)
+		return err
 	}
+	return nil
+}
 
-	if s.closed {
-		file, err := os.Open(s.filer.Name())
+// reopen opens a closed segment's files for writing
+func (s *segmenter) reopen() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	fPath := s.filer.Name()
+	if path.Ext(fPath) == ZFILER_EXT {
+		// compressed segment is decompressed for writing
+		zPath := fPath
+		fPath = strings.TrimSuffix(zPath, ZFILER_EXT) + FILER_EXT
+		z, err := openReadFiler(s.config.fs(), zPath)
 		if err != nil {
-			log.Printf("segmenter.Read() - error opening existing filer file: %s, error: %v", s.filer.Name(), err)
-			return nil, err
+			log.Printf("segmenter.reopen() - error opening compressed filer, err: %v", err)
+			return err
 		}
-
-		s.filer, err = newFiler(file)
+		err = decompressFiler(s.config.fs(), z, fPath)
+		z.Close()
 		if err != nil {
-			log.Printf("segmenter.Read() - error creating filer with existing file: %s, error: %v", s.filer.Name(), err)
-			return nil, err
+			return err
+		}
+		if err = s.config.fs().Remove(zPath); err != nil {
+			log.Printf("segmenter.reopen() - error removing compressed filer, err: %v", err)
+			return errors.WrapError(err, ERROR_REMOVING_FILER, zPath)
+		}
+		// compressed filer doesn't reappear after a crash, over records appended to the reopened segment
+		if err = s.config.fs().SyncDir(path.Dir(zPath)); err != nil {
+			log.Printf("segmenter.reopen() - error syncing segment directory, err: %v", err)
+			return err
 		}
-		log.Printf("segmenter.Read() - reopened closed filer")
+	}
+	filerFile, err := s.config.fs().OpenFile(fPath, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error opening filer file, err: %v", err)
+		return errors.WrapError(err, ERROR_OPENING_FILER, fPath)
+	}
+	ff, err := newFiler(filerFile)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error creating filer, err: %v", err)
+		return err
+	}
+	f, err := cipherFiler(ff, s.config, true)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error creating encrypting filer, err: %v", err)
+		ff.Close()
+		return err
+	}
+
+	indexFile, err := s.config.fs().OpenFile(s.indexer.Name(), os.O_RDWR, 0644)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error opening indexer file, err: %v", err)
+		return errors.WrapError(err, ERROR_OPENING_INDEX, s.indexer.Name())
+	}
+	idx, err := openIndexer(indexFile, s.config)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error creating indexer, err: %v", err)
+		return err
+	}
+
+	timeIndexFile, err := s.config.fs().OpenFile(s.timeIndexer.Name(), os.O_RDWR, 0644)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error opening time indexer file, err: %v", err)
+		return errors.WrapError(err, ERROR_OPENING_TIME_INDEX, s.timeIndexer.Name())
+	}
+	ti, err := newTimeIndexer(timeIndexFile)
+	if err != nil {
+		log.Printf("segmenter.reopen() - error creating time indexer, err: %v", err)
+		return err
+	}
+
+	// filers are read by compaction without the writer lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filer, s.indexer, s.timeIndexer, s.closed = f, idx, ti, false
+	return nil
+}
+
+// Read returns the record at offset off, or the next available
+// record if off is missing from a segment with offset gaps
+func (s *segmenter) Read(off uint64) (*api.Record, error) {
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	_, pos, err := s.indexer.Read(int64(off - s.baseOffset))
+	if err != nil {
+		log.Printf("segmenter.Read() - error reading index, error: %v", err)
+		return nil, err
+	}
+
+	f, err := s.readFiler()
+	if err != nil {
+		return nil, err
 	}
 	log.Printf("segmenter.Read() - reading position: %d", pos)
-	p, err := s.filer.Read(pos)
+	p, err := f.Read(pos)
 	if err != nil {
 		log.Printf("segmenter.Read() - error reading position from filer, error: %v", err)
 		return nil, err
@@ -159,11 +593,223 @@ func (s *segmenter) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// readFiler returns the filer to read records from,
+// a closed segment's filer is reopened read only once
+func (s *segmenter) readFiler() (Filer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		return s.filer, nil
+	}
+	if s.reader == nil {
+		rf, err := openReadFiler(s.config.fs(), s.filer.Name())
+		if err != nil && path.Ext(s.filer.Name()) == FILER_EXT {
+			// filer compressed since the segment was opened, by a writer alongside read only segments
+			if zf, zerr := openReadFiler(s.config.fs(), compressedPath(s.filer.Name())); zerr == nil {
+				rf, err = zf, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		f, err := cipherFiler(rf, s.config, false)
+		if err != nil {
+			rf.Close()
+			return nil, err
+		}
+		s.reader = f
+		log.Printf("segmenter.readFiler() - reopened closed filer")
+	}
+	return s.reader, nil
+}
+
+// openReadFiler opens an existing filer file for reading,
+// compressed or not depending on file extension
+func openReadFiler(fsys FS, name string) (Filer, error) {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		log.Printf("segmenter.openReadFiler() - error opening existing filer file: %s, error: %v", name, err)
+		return nil, errors.WrapError(err, ERROR_OPENING_FILER, name)
+	}
+	var f Filer
+	if path.Ext(name) == ZFILER_EXT {
+		f, err = newZfiler(file)
+	} else {
+		f, err = newFiler(file)
+	}
+	if err != nil {
+		log.Printf("segmenter.openReadFiler() - error creating filer with existing file: %s, error: %v", name, err)
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Compress closes the segment, replacing its filer with a block compressed filer
+// of blockSize uncompressed bytes per block. Compressed segments are read only.
+func (s *segmenter) Compress(blockSize uint64) error {
+	if s.compressed() {
+		return nil
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	f, err := s.readFiler()
+	if err != nil {
+		return err
+	}
+	zPath := compressedPath(f.Name())
+	// encrypted records are compressed as they are
+	if err = compressFiler(s.config.fs(), rawFiler(f), zPath, blockSize); err != nil {
+		return err
+	}
+	return s.UseCompressed(zPath)
+}
+
+// UseCompressed swaps the sealed segment's filer for the compressed filer
+// written at zPath, removing the uncompressed filer
+func (s *segmenter) UseCompressed(zPath string) error {
+	fPath := s.filer.Name()
+	zf, err := openReadFiler(s.config.fs(), zPath)
+	if err != nil {
+		return err
+	}
+	z, err := cipherFiler(zf, s.config, false)
+	if err != nil {
+		zf.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader != nil {
+		if err = s.reader.Close(); err != nil {
+			log.Printf("segmenter.UseCompressed() - error closing read only filer, error: %v", err)
+		}
+	}
+	s.filer, s.reader = z, z
+	if err = s.config.fs().Remove(fPath); err != nil {
+		log.Printf("segmenter.UseCompressed() - error removing uncompressed filer %s, error: %v", fPath, err)
+		return errors.WrapError(err, ERROR_REMOVING_FILER, fPath)
+	}
+	log.Printf("segmenter.UseCompressed() - compressed segment, base offset: %d, size: %d, compressed size: %d", s.baseOffset, z.Size(), s.filerSize())
+	return nil
+}
+
+// compressedPath returns the path of the compressed filer of filer at fPath
+func compressedPath(fPath string) string {
+	return strings.TrimSuffix(fPath, FILER_EXT) + ZFILER_EXT
+}
+
+// compressed checks if the segment's filer is block compressed
+func (s *segmenter) compressed() bool {
+	return path.Ext(s.filer.Name()) == ZFILER_EXT
+}
+
+// filerSize returns the bytes of segment's filer file on disk
+func (s *segmenter) filerSize() uint64 {
+	if z, ok := rawFiler(s.filer).(*zfiler); ok {
+		return z.StoredSize()
+	}
+	return s.filer.Size()
+}
+
+// IsMaxed checks if the segment hit any of entries, bytes or age limits.
+// Compressed segments, and unencrypted segments with records once encryption
+// is enabled, take no more records.
 func (s *segmenter) IsMaxed() bool {
-	return s.indexer.Size() >= s.config.Segment.MaxIndexSize
+	if s.compressed() {
+		return true
+	}
+	if _, ok := s.filer.(*cryptFiler); !ok && s.config.Encryption.KeyProvider != nil && s.filer.Size() > 0 {
+		return true
+	}
+	c := s.config.Segment
+	if s.indexer.Size() >= c.MaxIndexSize {
+		return true
+	}
+	if c.MaxStoreBytes > 0 && s.filer.Size() >= c.MaxStoreBytes {
+		return true
+	}
+	return c.MaxSegmentAge > 0 && s.nextOffset > s.baseOffset &&
+		s.config.clock().Now().Sub(s.firstAppended) >= c.MaxSegmentAge
+}
+
+// Fits checks if the record can be appended within segment's max store bytes.
+// An empty segment takes any record, so that oversized records get their own segment.
+func (s *segmenter) Fits(record *api.Record) bool {
+	max := s.config.Segment.MaxStoreBytes
+	if max == 0 || s.nextOffset == s.baseOffset {
+		return true
+	}
+	size := frameSize(record, s.nextOffset, s.config.clock().Now().UnixNano())
+	if _, ok := s.filer.(*cryptFiler); ok {
+		size += ENCRYPTION_OVERHEAD
+	}
+	return s.filer.Size()+size <= max
+}
+
+// frameSize returns filer bytes of the record appended at offset off, time ts
+func frameSize(record *api.Record, off uint64, ts int64) uint64 {
+	n := proto.Size(record) -
+		fieldSize(RECORD_OFFSET_FIELD, record.Offset) + fieldSize(RECORD_OFFSET_FIELD, off) -
+		fieldSize(RECORD_TIMESTAMP_FIELD, uint64(record.Timestamp)) + fieldSize(RECORD_TIMESTAMP_FIELD, uint64(ts))
+	return FRAME_HEADER_WIDTH + uint64(n)
+}
+
+// fieldSize returns marshalled bytes of a record varint field
+func fieldSize(num protowire.Number, v uint64) int {
+	if v == 0 {
+		return 0
+	}
+	return protowire.SizeTag(num) + protowire.SizeVarint(v)
+}
+
+// Flush hands appended records over to the OS,
+// so that they survive a process crash
+func (s *segmenter) Flush() error {
+	if s.closed {
+		return nil
+	}
+	return s.filer.Flush()
+}
+
+// Sync commits appended records and their index entries to stable storage
+func (s *segmenter) Sync() error {
+	if s.closed {
+		return nil
+	}
+	if err := s.filer.Sync(); err != nil {
+		log.Printf("segmenter.Sync() - error syncing filer, error: %v", err)
+		return err
+	}
+	if err := s.indexer.Sync(); err != nil {
+		log.Printf("segmenter.Sync() - error syncing indexer, error: %v", err)
+		return err
+	}
+	if err := s.timeIndexer.Sync(); err != nil {
+		log.Printf("segmenter.Sync() - error syncing time indexer, error: %v", err)
+		return err
+	}
+	return nil
 }
 
 func (s *segmenter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reader != nil {
+		err := s.reader.Close()
+		s.reader = nil
+		if err != nil {
+			log.Printf("segmenter.Close() - error closing read only filer, error: %v", err)
+			return err
+		}
+	}
+	if s.closed {
+		return nil
+	}
 	log.Printf("segmenter.Close() - closing segmenter - offset - base: %d, next: %d", s.baseOffset, s.nextOffset)
 	if err := s.indexer.Close(); err != nil {
 		log.Printf("segmenter.Close() - error closing indexer, error: %v", err)
@@ -173,25 +819,31 @@ func (s *segmenter) Close() error {
 		log.Printf("segmenter.Close() - error closing filer, error: %v", err)
 		return err
 	}
+	if err := s.timeIndexer.Close(); err != nil {
+		log.Printf("segmenter.Close() - error closing time indexer, error: %v", err)
+		return err
+	}
 	s.closed = true
 	return nil
 }
 
 func (s *segmenter) Remove() error {
-	if !s.Closed() {
-		if err := s.Close(); err != nil {
-			log.Printf("segmenter.Remove() - error removing segmenter")
-			return err
-		}
+	if err := s.Close(); err != nil {
+		log.Printf("segmenter.Remove() - error removing segmenter")
+		return err
 	}
-	if err := os.Remove(s.indexer.Name()); err != nil {
+	if err := s.config.fs().Remove(s.indexer.Name()); err != nil {
 		log.Printf("segmenter.Remove() - error removing segmenter indexer file")
 		return errors.WrapError(err, ERROR_REMOVING_INDEX, s.indexer.Name())
 	}
-	if err := os.Remove(s.filer.Name()); err != nil {
+	if err := s.config.fs().Remove(s.filer.Name()); err != nil {
 		log.Printf("segmenter.Remove() - error removing segmenter filer file")
 		return errors.WrapError(err, ERROR_REMOVING_FILER, s.filer.Name())
 	}
+	if err := s.config.fs().Remove(s.timeIndexer.Name()); err != nil {
+		log.Printf("segmenter.Remove() - error removing segmenter time indexer file")
+		return errors.WrapError(err, ERROR_REMOVING_TIME_INDEX, s.timeIndexer.Name())
+	}
 	return nil
 }
 
@@ -207,6 +859,41 @@ func (s *segmenter) NextOffset() uint64 {
 	return s.nextOffset
 }
 
+// LastAppended returns the time of segment's newest record,
+// zero for an empty segment
+func (s *segmenter) LastAppended() time.Time {
+	return s.lastAppended
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// unix nano timestamp ts, io.EOF if every record in the segment is older
+func (s *segmenter) OffsetForTime(ts int64) (uint64, error) {
+	off, err := s.timeIndexer.Search(ts)
+	if err != nil {
+		return 0, err
+	}
+	return s.baseOffset + uint64(off), nil
+}
+
+// Size returns the bytes of segment's filer and index files
+func (s *segmenter) Size() uint64 {
+	return s.filerSize() + s.indexSize() + s.timeIndexer.Size()*TIME_ENTRY_WIDTH
+}
+
+// indexSize returns the bytes of segment's index file on disk,
+// memory mapped indexes being preallocated past their entries
+func (s *segmenter) indexSize() uint64 {
+	fi, err := s.config.fs().Stat(s.indexer.Name())
+	if err != nil {
+		return s.indexer.Size() * ENTRY_WIDTH
+	}
+	return uint64(fi.Size())
+}
+
 func (s *segmenter) Filer() Filer {
-	return s.filer
+	f, err := s.readFiler()
+	if err != nil {
+		return s.filer
+	}
+	return f
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -75,3 +76,356 @@ func TestSegmenter(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmenterRebuildsIndex(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 5
+
+	s, err := newSegmenter(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	err = s.Close()
+	require.NoError(t, err)
+
+	iPath := s.indexer.Name()
+	fPath := s.filer.Name()
+
+	for scenario, damage := range map[string]func(t *testing.T){
+		"missing index": func(t *testing.T) {
+			require.NoError(t, os.Remove(iPath))
+		},
+		"empty index": func(t *testing.T) {
+			require.NoError(t, os.Truncate(iPath, 0))
+		},
+		"corrupt index": func(t *testing.T) {
+			require.NoError(t, os.WriteFile(iPath, []byte("not an index"), 0644))
+		},
+		"torn record": func(t *testing.T) {
+			f, err := os.OpenFile(fPath, os.O_WRONLY|os.O_APPEND, 0644)
+			require.NoError(t, err)
+			_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 64, 1, 2, 3})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fi, err := os.Stat(fPath)
+			require.NoError(t, err)
+			size := fi.Size()
+
+			damage(t)
+
+			s, err := newSegmenter(dir, 16, c)
+			require.NoError(t, err)
+			require.Equal(t, uint64(19), s.NextOffset())
+			require.Equal(t, uint64(3), s.indexer.Size())
+			require.Equal(t, uint64(size), s.filer.Size())
+
+			for off := uint64(16); off < 19; off++ {
+				got, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, got.Offset)
+				require.Equal(t, want.Value, got.Value)
+			}
+			require.NoError(t, s.Close())
+
+			fi, err = os.Stat(iPath)
+			require.NoError(t, err)
+			require.Equal(t, int64(3*ENTRY_WIDTH), fi.Size())
+		})
+	}
+}
+
+func TestSegmenterCorruptRecord(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+
+	s, err := newSegmenter(dir, 0, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, pos, err := s.indexer.Read(2)
+	require.NoError(t, err)
+	err = s.Close()
+	require.NoError(t, err)
+
+	iPath := s.indexer.Name()
+	fPath := s.filer.Name()
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	size := fi.Size()
+
+	// flip a byte inside record 2, rebuilding the index
+	f, err := os.OpenFile(fPath, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+FRAME_HEADER_WIDTH+2))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^b[0]}, int64(pos+FRAME_HEADER_WIDTH+2))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Remove(iPath))
+
+	// corrupt record before the last record fails the open, records are kept
+	_, err = newSegmenter(dir, 0, c)
+	require.Error(t, err)
+	cerr, ok := err.(*CorruptRecordError)
+	require.True(t, ok)
+	require.Equal(t, pos, cerr.Pos)
+	fi, err = os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, size, fi.Size())
+}
+
+func TestSegmenterAppendBatch(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 5
+
+	s, err := newSegmenter(dir, 16, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{}
+	for i := 0; i < 7; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+
+	// batch is appended up to segment max
+	first, last, n, err := s.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), first)
+	require.Equal(t, uint64(20), last)
+	require.Equal(t, 5, n)
+	require.True(t, s.IsMaxed())
+
+	_, _, _, err = s.AppendBatch(records[5:])
+	require.Equal(t, io.EOF, err)
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	// closed segment is reopened and truncated
+	err = s.TruncateFrom(18)
+	require.NoError(t, err)
+	require.False(t, s.Closed())
+	require.Equal(t, uint64(18), s.NextOffset())
+	require.Equal(t, uint64(2), s.indexer.Size())
+
+	_, err = s.Read(18)
+	require.Error(t, err)
+
+	first, last, n, err = s.AppendBatch(records[5:])
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), first)
+	require.Equal(t, uint64(19), last)
+	require.Equal(t, 2, n)
+
+	for off, i := uint64(16), 0; off < 20; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		if off == 18 {
+			i = 5
+		}
+		require.Equal(t, fmt.Sprintf("record %d", i), string(got.Value))
+		i++
+	}
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	s, err = newSegmenter(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), s.NextOffset())
+	err = s.Close()
+	require.NoError(t, err)
+}
+
+func TestSegmenterMaxed(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	small := &api.Record{Value: []byte("hello world")}
+	large := &api.Record{Value: make([]byte, 256)}
+	recordSize := frameSize(small, 1, time.Now().UnixNano())
+
+	t.Run("store bytes", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxIndexSize = 100
+		c.Segment.MaxStoreBytes = 3 * recordSize
+
+		s, err := newSegmenter(dir, 1, c)
+		require.NoError(t, err)
+		defer s.Remove()
+
+		// oversized record doesn't fit a non empty segment
+		_, err = s.Append(small)
+		require.NoError(t, err)
+		require.False(t, s.Fits(large))
+		_, err = s.Append(large)
+		require.Equal(t, io.EOF, err)
+		_, _, _, err = s.AppendBatch([]*api.Record{large, small})
+		require.Equal(t, io.EOF, err)
+
+		// batch is appended up to max store bytes
+		first, last, n, err := s.AppendBatch([]*api.Record{small, small, small})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), first)
+		require.Equal(t, uint64(3), last)
+		require.Equal(t, 2, n)
+		require.Equal(t, 3*recordSize, s.filer.Size())
+		require.True(t, s.IsMaxed())
+	})
+
+	t.Run("oversized record", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxIndexSize = 100
+		c.Segment.MaxStoreBytes = 3 * recordSize
+
+		s, err := newSegmenter(dir, 10, c)
+		require.NoError(t, err)
+		defer s.Remove()
+
+		// empty segment takes an oversized record
+		require.True(t, s.Fits(large))
+		off, err := s.Append(large)
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), off)
+		require.True(t, s.IsMaxed())
+	})
+
+	t.Run("segment age", func(t *testing.T) {
+		clock := newFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+		c := Config{Clock: clock}
+		c.Segment.MaxIndexSize = 100
+		c.Segment.MaxSegmentAge = time.Hour
+
+		s, err := newSegmenter(dir, 20, c)
+		require.NoError(t, err)
+		defer s.Remove()
+
+		// empty segment doesn't age
+		clock.Advance(2 * time.Hour)
+		require.False(t, s.IsMaxed())
+
+		_, err = s.Append(small)
+		require.NoError(t, err)
+		clock.Advance(59 * time.Minute)
+		_, err = s.Append(small)
+		require.NoError(t, err)
+		require.False(t, s.IsMaxed())
+
+		// age counts from the first record, across reopens
+		err = s.Close()
+		require.NoError(t, err)
+		s, err = newSegmenter(dir, 20, c)
+		require.NoError(t, err)
+		require.False(t, s.IsMaxed())
+		clock.Advance(time.Minute)
+		require.True(t, s.IsMaxed())
+
+		// emptied segment starts over
+		err = s.TruncateFrom(20)
+		require.NoError(t, err)
+		require.False(t, s.IsMaxed())
+	})
+}
+
+func TestSegmenterOffsetGaps(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 10
+
+	s, err := newSegmenter(dir, 10, c)
+	require.NoError(t, err)
+
+	for _, off := range []uint64{11, 14, 15} {
+		err = s.write(&api.Record{Value: []byte(fmt.Sprintf("record %d", off)), Offset: off})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(16), s.NextOffset())
+
+	// reads resolve to the next available offset
+	for want, offs := range map[uint64][]uint64{
+		11: {10, 11},
+		14: {12, 13, 14},
+		15: {15},
+	} {
+		for _, off := range offs {
+			record, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want, record.Offset)
+		}
+	}
+	_, err = s.Read(16)
+	require.Error(t, err)
+
+	// index with gaps is rebuilt from the filer
+	err = s.Close()
+	require.NoError(t, err)
+	err = os.Truncate(s.indexer.Name(), 0)
+	require.NoError(t, err)
+	s, err = newSegmenter(dir, 10, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.indexer.Size())
+	require.Equal(t, uint64(16), s.NextOffset())
+
+	// truncating from a missing offset discards the following records
+	err = s.TruncateFrom(13)
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), s.NextOffset())
+	require.Equal(t, uint64(1), s.indexer.Size())
+	off, err := s.Append(&api.Record{Value: []byte("record 13")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), off)
+
+	err = s.Remove()
+	require.NoError(t, err)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/comfforts/recorder"
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+const (
+	ERROR_MISSING_RECORD string = "error missing record"
+)
+
+// grpcServer serves a recorder over gRPC
+type grpcServer struct {
+	api.UnimplementedRecorderServer
+	recorder recorder.Recorder
+}
+
+var _ api.RecorderServer = (*grpcServer)(nil)
+
+// NewGRPCServer returns a gRPC server with recorder service registered
+func NewGRPCServer(r recorder.Recorder, opts ...grpc.ServerOption) *grpc.Server {
+	gsrv := grpc.NewServer(opts...)
+	api.RegisterRecorderServer(gsrv, &grpcServer{
+		recorder: r,
+	})
+	return gsrv
+}
+
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, ERROR_MISSING_RECORD)
+	}
+	off, err := s.recorder.Append(req.Record)
+	if err != nil {
+		log.Printf("grpcServer.Produce() - error appending record, error: %v", err)
+		return nil, appendError(err)
+	}
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	if err := s.inRange(req.Offset); err != nil {
+		return nil, err
+	}
+	record, err := s.recorder.Read(req.Offset)
+	if err != nil {
+		log.Printf("grpcServer.Consume() - error reading record, offset: %d, error: %v", req.Offset, err)
+		return nil, readError(err)
+	}
+	return &api.ConsumeResponse{Record: record}, nil
+}
+
+// readError maps recorder's error reading a record to a status error,
+// out of range outside the log's range and not found for offsets dropped by compaction
+func readError(err error) error {
+	var rerr *recorder.OffsetOutOfRangeError
+	var nerr *recorder.RecordNotFoundError
+	switch {
+	case errors.As(err, &rerr):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.As(err, &nerr):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// appendError maps recorder's error appending records to a status error
+func appendError(err error) error {
+	switch {
+	case errors.Is(err, recorder.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, recorder.ErrRecorderClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *grpcServer) ProduceStream(stream api.Recorder_ProduceStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// ConsumeStream streams records from requested offset,
+// blocking for new records until client cancels
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Recorder_ConsumeStreamServer) error {
+	lowest, err := s.recorder.LowestOffset()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if req.Offset < lowest {
+		return status.Errorf(codes.OutOfRange, recorder.ERROR_OFFSET_OUT_OF_RANGE, req.Offset)
+	}
+
+	sub, err := s.recorder.Subscribe(stream.Context(), req.Offset)
+	if err != nil {
+		log.Printf("grpcServer.ConsumeStream() - error subscribing, offset: %d, error: %v", req.Offset, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	for record := range sub.Records() {
+		if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+	if err = sub.Err(); err != nil && stream.Context().Err() == nil {
+		log.Printf("grpcServer.ConsumeStream() - subscription ended, error: %v", err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	lowest, err := s.recorder.LowestOffset()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	highest, err := s.recorder.HighestOffset()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &api.GetOffsetsResponse{Lowest: lowest, Highest: highest}, nil
+}
+
+// inRange checks offset is within recorder's offsets
+func (s *grpcServer) inRange(off uint64) error {
+	lowest, err := s.recorder.LowestOffset()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	highest, err := s.recorder.HighestOffset()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if off < lowest || off > highest {
+		return status.Errorf(codes.OutOfRange, recorder.ERROR_OFFSET_OUT_OF_RANGE, off)
+	}
+	return nil
+}
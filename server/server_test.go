@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/comfforts/recorder"
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+const TEST_DATA_DIR = "data"
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, client api.RecorderClient, r recorder.Recorder,
+	){
+		"produce and consume a record succeeds": testProduceConsume,
+		"consume past log boundary fails":       testConsumePastBoundary,
+		"produce and consume stream succeeds":   testProduceConsumeStream,
+		"get offsets":                           testGetOffsets,
+		"consume empty or compacted log fails":  testConsumeMissing,
+		"produce to closed recorder fails":      testProduceClosed,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, r, teardown := setupTest(t)
+			defer teardown()
+			fn(t, client, r)
+		})
+	}
+}
+
+func setupTest(t *testing.T) (api.RecorderClient, recorder.Recorder, func()) {
+	t.Helper()
+
+	dir := TEST_DATA_DIR + "/"
+	err := os.MkdirAll(dir, os.ModePerm)
+	require.NoError(t, err)
+
+	c := recorder.Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := recorder.NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	l := bufconn.Listen(1024 * 1024)
+	gsrv := NewGRPCServer(r)
+	go func() {
+		_ = gsrv.Serve(l)
+	}()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	return api.NewRecorderClient(conn), r, func() {
+		conn.Close()
+		gsrv.Stop()
+		l.Close()
+		r.Remove()
+	}
+}
+
+func testProduceConsume(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx := context.Background()
+
+	want := &api.Record{Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testConsumePastBoundary(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset + 1})
+	require.Nil(t, consume)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func testProduceConsumeStream(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+		{Value: []byte("fourth message")},
+	}
+
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for off, record := range records {
+		err = produce.Send(&api.ProduceRequest{Record: record})
+		require.NoError(t, err)
+		res, err := produce.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(off), res.Offset)
+	}
+	err = produce.CloseSend()
+	require.NoError(t, err)
+	_, err = produce.Recv()
+	require.Equal(t, io.EOF, err)
+
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	for off := uint64(1); off < uint64(len(records)); off++ {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+		require.Equal(t, records[off].Value, res.Record.Value)
+	}
+
+	// stream blocks for new records
+	want := &api.Record{Value: []byte("fifth message")}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	res, err := consume.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(records)), res.Record.Offset)
+	require.Equal(t, want.Value, res.Record.Value)
+}
+
+func testGetOffsets(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(4), offsets.Highest)
+}
+
+func testConsumeMissing(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx := context.Background()
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Nil(t, consume)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// offset 0 is dropped by compaction, offset 1 is kept
+	for _, record := range []*api.Record{
+		{Key: []byte("k1"), Value: []byte("a")},
+		{Value: []byte("no key")},
+		{Key: []byte("k1"), Value: []byte("b")},
+		{Value: []byte("no key")},
+	} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.NoError(t, err)
+	}
+	err = r.Compact()
+	require.NoError(t, err)
+
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Nil(t, consume)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), consume.Record.Offset)
+}
+
+func testProduceClosed(t *testing.T, client api.RecorderClient, r recorder.Recorder) {
+	ctx := context.Background()
+
+	err := r.Close()
+	require.NoError(t, err)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Nil(t, produce)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// read only recorders reject appends
+	require.Equal(t, codes.FailedPrecondition, status.Code(appendError(recorder.ErrReadOnly)))
+}
@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"context"
+	"log"
+	"math"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+// Subscription delivers existing records from an offset onwards,
+// followed by records as they're appended
+type Subscription interface {
+	// Records returns the record channel, closed when the subscription ends
+	Records() <-chan *api.Record
+	// Err returns the error that ended the subscription, once records channel is closed
+	Err() error
+}
+
+type subscription struct {
+	r       *recorder
+	next    uint64
+	records chan *api.Record
+	err     error
+}
+
+// Subscribe delivers records from offset from onwards, blocking for new records
+// once existing ones are delivered, until ctx is done or the recorder is closed
+func (r *recorder) Subscribe(ctx context.Context, from uint64) (Subscription, error) {
+	r.mu.RLock()
+	lowest := r.segments[0].BaseOffset()
+	done := r.done
+	r.mu.RUnlock()
+	if done == nil {
+		return nil, ErrRecorderClosed
+	}
+	if from < lowest {
+		log.Printf("recorder.Subscribe() - offset below lowest offset, offset: %d, lowest: %d", from, lowest)
+		return nil, &OffsetOutOfRangeError{Offset: from}
+	}
+
+	s := &subscription{
+		r:       r,
+		next:    from,
+		records: make(chan *api.Record),
+	}
+	go s.run(ctx, done)
+	return s, nil
+}
+
+func (s *subscription) run(ctx context.Context, done <-chan struct{}) {
+	defer close(s.records)
+	for {
+		// appended notification is taken before reading,
+		// so that records appended meanwhile aren't missed
+		s.r.mu.RLock()
+		appended := s.r.appended
+		s.r.mu.RUnlock()
+
+		it := s.r.Iterator(s.next, math.MaxUint64)
+		for it.Next() {
+			select {
+			case s.records <- it.Record():
+				s.next = it.Record().Offset + 1
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			case <-done:
+				s.err = ErrRecorderClosed
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			log.Printf("subscription.run() - error reading records, offset: %d, error: %v", s.next, err)
+			s.err = err
+			return
+		}
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+		case <-done:
+			s.err = ErrRecorderClosed
+			return
+		}
+	}
+}
+
+func (s *subscription) Records() <-chan *api.Record {
+	return s.records
+}
+
+func (s *subscription) Err() error {
+	return s.err
+}
@@ -0,0 +1,72 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/comfforts/recorder/api/v1"
+)
+
+func TestSubscription(t *testing.T) {
+	dir := fmt.Sprintf("%s/", TEST_DATA_DIR)
+	err := createDirectory(dir)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexSize = 3
+	r, err := NewRecorder(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := r.Subscribe(ctx, 1)
+	require.NoError(t, err)
+
+	// appends across segment rollovers are delivered
+	go func() {
+		for i := 2; i < 10; i++ {
+			time.Sleep(time.Millisecond)
+			if _, err := r.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for off := uint64(1); off < 10; off++ {
+		select {
+		case record := <-sub.Records():
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for offset %d", off)
+		}
+	}
+
+	cancel()
+	_, ok := <-sub.Records()
+	require.False(t, ok)
+	require.Equal(t, context.Canceled, sub.Err())
+
+	// closing recorder ends subscriptions
+	sub, err = r.Subscribe(context.Background(), 10)
+	require.NoError(t, err)
+	err = r.Close()
+	require.NoError(t, err)
+	_, ok = <-sub.Records()
+	require.False(t, ok)
+	require.Equal(t, ErrRecorderClosed, sub.Err())
+
+	_, err = r.Subscribe(context.Background(), 0)
+	require.Equal(t, ErrRecorderClosed, err)
+}
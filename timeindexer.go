@@ -0,0 +1,214 @@
+package recorder
+
+import (
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/comfforts/errors"
+)
+
+var (
+	TIMESTAMP_WIDTH  uint64 = 8
+	TIME_ENTRY_WIDTH        = TIMESTAMP_WIDTH + OFFSET_WIDTH
+)
+
+const (
+	ERROR_WRITING_TIME_ENTRY  string = "error writing time index entry in %s"
+	ERROR_LOADING_TIME_INDEX  string = "error loading time index file %s"
+	ERROR_TRUNCATING_TIME_IDX string = "error truncating time index file %s"
+)
+
+// TimeIndexer maps append timestamps to segment offsets
+type TimeIndexer interface {
+	Write(ts int64, off uint32) error
+	Search(ts int64) (off uint32, err error)
+	First() (ts int64, off uint32, err error)
+	Last() (ts int64, off uint32, err error)
+	Truncate(off uint32) error
+	Sync() error
+	Close() error
+	Name() string
+	Size() uint64
+}
+
+type timeEntry struct {
+	ts  int64
+	off uint32
+}
+
+// timeIndexer: append only fixed width (timestamp, offset) entries, one per record,
+// with timestamps kept non decreasing so that entries can be binary searched
+type timeIndexer struct {
+	file    File
+	entries []timeEntry
+	mu      sync.Mutex
+}
+
+func newTimeIndexer(f File) (*timeIndexer, error) {
+	ti := &timeIndexer{
+		file: f,
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("timeIndexer.newTimeIndexer() - error getting file stats, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_NO_FILE, f.Name())
+	}
+	if fi.Size() == 0 {
+		return ti, nil
+	}
+
+	b := make([]byte, fi.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		log.Printf("timeIndexer.newTimeIndexer() - error reading time index file, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_LOADING_TIME_INDEX, f.Name())
+	}
+	n := uint64(len(b)) / TIME_ENTRY_WIDTH
+	for j := uint64(0); j < n; j++ {
+		e := decodeTimeEntry(b[j*TIME_ENTRY_WIDTH:])
+		if j > 0 && (e.ts < ti.entries[j-1].ts || e.off <= ti.entries[j-1].off) {
+			log.Printf("timeIndexer.newTimeIndexer() - error unexpected time index entry, entry: %d", j)
+			return nil, errors.NewAppError(ERROR_LOADING_TIME_INDEX, f.Name())
+		}
+		ti.entries = append(ti.entries, e)
+	}
+
+	// torn trailing entry is discarded
+	if uint64(len(b)) > n*TIME_ENTRY_WIDTH {
+		log.Printf("timeIndexer.newTimeIndexer() - truncating torn time index entry, file: %s, entries: %d", f.Name(), n)
+		if err := f.Truncate(int64(n * TIME_ENTRY_WIDTH)); err != nil {
+			return nil, errors.WrapError(err, ERROR_LOADING_TIME_INDEX, f.Name())
+		}
+	}
+	return ti, nil
+}
+
+// Write appends the timestamp of record at relative offset off,
+// a timestamp older than the last one is raised to it
+func (ti *timeIndexer) Write(ts int64, off uint32) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if n := len(ti.entries); n > 0 {
+		last := ti.entries[n-1]
+		if off == last.off {
+			return ErrDuplicateOffset
+		}
+		// offsets are appended in increasing order
+		if off < last.off {
+			log.Printf("timeIndexer.Write() - error offset less than last offset, returning io.EOF, offset: %d, last offset: %d", off, last.off)
+			return io.EOF
+		}
+		if ts < last.ts {
+			ts = last.ts
+		}
+	}
+	e := timeEntry{ts: ts, off: off}
+	if _, err := ti.file.WriteAt(encodeTimeEntry(e), int64(uint64(len(ti.entries))*TIME_ENTRY_WIDTH)); err != nil {
+		log.Printf("timeIndexer.Write() - error writing time index entry, error: %v", err)
+		return errors.WrapError(err, ERROR_WRITING_TIME_ENTRY, ti.Name())
+	}
+	ti.entries = append(ti.entries, e)
+	return nil
+}
+
+// Search returns relative offset of the first record appended at or after ts,
+// io.EOF if every record is older
+func (ti *timeIndexer) Search(ts int64) (uint32, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	j := sort.Search(len(ti.entries), func(j int) bool {
+		return ti.entries[j].ts >= ts
+	})
+	if j == len(ti.entries) {
+		return 0, io.EOF
+	}
+	return ti.entries[j].off, nil
+}
+
+// First returns the first entry, io.EOF for an empty time index
+func (ti *timeIndexer) First() (int64, uint32, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if len(ti.entries) == 0 {
+		return 0, 0, io.EOF
+	}
+	first := ti.entries[0]
+	return first.ts, first.off, nil
+}
+
+// Last returns the last entry, io.EOF for an empty time index
+func (ti *timeIndexer) Last() (int64, uint32, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if len(ti.entries) == 0 {
+		return 0, 0, io.EOF
+	}
+	last := ti.entries[len(ti.entries)-1]
+	return last.ts, last.off, nil
+}
+
+// Truncate discards entries from relative offset off onwards
+func (ti *timeIndexer) Truncate(off uint32) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	n := sort.Search(len(ti.entries), func(j int) bool {
+		return ti.entries[j].off >= off
+	})
+	if n == len(ti.entries) {
+		return nil
+	}
+	if err := ti.file.Truncate(int64(uint64(n) * TIME_ENTRY_WIDTH)); err != nil {
+		log.Printf("timeIndexer.Truncate() - error truncating time index file, error: %v", err)
+		return errors.WrapError(err, ERROR_TRUNCATING_TIME_IDX, ti.Name())
+	}
+	ti.entries = ti.entries[:n]
+	return nil
+}
+
+// Sync commits time index entries to stable storage
+func (ti *timeIndexer) Sync() error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if err := ti.file.Sync(); err != nil {
+		log.Printf("timeIndexer.Sync() - error syncing time index file, error: %v", err)
+		return errors.WrapError(err, ERROR_SYNCING_INDEX_FILE, ti.Name())
+	}
+	return nil
+}
+
+func (ti *timeIndexer) Close() error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.file.Close()
+}
+
+func (ti *timeIndexer) Name() string {
+	return ti.file.Name()
+}
+
+func (ti *timeIndexer) Size() uint64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return uint64(len(ti.entries))
+}
+
+func encodeTimeEntry(e timeEntry) []byte {
+	b := make([]byte, TIME_ENTRY_WIDTH)
+	ENCODING.PutUint64(b[:TIMESTAMP_WIDTH], uint64(e.ts))
+	ENCODING.PutUint32(b[TIMESTAMP_WIDTH:TIME_ENTRY_WIDTH], e.off)
+	return b
+}
+
+func decodeTimeEntry(b []byte) timeEntry {
+	return timeEntry{
+		ts:  int64(ENCODING.Uint64(b[:TIMESTAMP_WIDTH])),
+		off: ENCODING.Uint32(b[TIMESTAMP_WIDTH:TIME_ENTRY_WIDTH]),
+	}
+}
@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndexer(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "time_indexer_test")
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	f, err := os.Create(fPath)
+	require.NoError(t, err)
+	ti, err := newTimeIndexer(f)
+	require.NoError(t, err)
+
+	_, _, err = ti.First()
+	require.Equal(t, io.EOF, err)
+	_, _, err = ti.Last()
+	require.Equal(t, io.EOF, err)
+	_, err = ti.Search(0)
+	require.Equal(t, io.EOF, err)
+
+	entries := []struct {
+		ts  int64
+		off uint32
+	}{
+		{ts: 100, off: 0},
+		{ts: 200, off: 1},
+		// clock went back, raised to last timestamp
+		{ts: 150, off: 2},
+		{ts: 300, off: 4},
+	}
+	for _, e := range entries {
+		err = ti.Write(e.ts, e.off)
+		require.NoError(t, err)
+	}
+	err = ti.Write(400, 4)
+	require.Equal(t, ErrDuplicateOffset, err)
+	err = ti.Write(400, 3)
+	require.Equal(t, io.EOF, err)
+
+	for ts, want := range map[int64]uint32{
+		0:   0,
+		100: 0,
+		101: 1,
+		200: 1,
+		201: 4,
+		300: 4,
+	} {
+		off, err := ti.Search(ts)
+		require.NoError(t, err)
+		require.Equal(t, want, off, "timestamp %d", ts)
+	}
+	_, err = ti.Search(301)
+	require.Equal(t, io.EOF, err)
+
+	err = ti.Truncate(3)
+	require.NoError(t, err)
+	ts, off, err := ti.Last()
+	require.NoError(t, err)
+	require.Equal(t, int64(200), ts)
+	require.Equal(t, uint32(2), off)
+	ts, off, err = ti.First()
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ts)
+	require.Equal(t, uint32(0), off)
+	err = ti.Close()
+	require.NoError(t, err)
+
+	// entries are loaded from file, torn trailing entry is discarded
+	f, err = os.OpenFile(fPath, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 1}, int64(3*TIME_ENTRY_WIDTH))
+	require.NoError(t, err)
+	ti, err = newTimeIndexer(f)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ti.Size())
+	off, err = ti.Search(150)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+
+	fi, err := os.Stat(fPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*TIME_ENTRY_WIDTH), fi.Size())
+	err = ti.Close()
+	require.NoError(t, err)
+}
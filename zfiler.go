@@ -0,0 +1,304 @@
+package recorder
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/comfforts/errors"
+)
+
+// compressed filer file layout: flate compressed blocks of whole record frames,
+// followed by a block index of (position, compressed position) entries
+// and a footer of (size, block count, magic)
+const (
+	ZFILER_MAGIC        uint32 = 0x5a464c52
+	BLOCK_ENTRY_WIDTH          = 16
+	ZFILER_FOOTER_WIDTH        = 20
+	DEFAULT_BLOCK_SIZE         = 64 * 1024
+)
+
+const (
+	ERROR_READ_ONLY_FILER   string = "filer %s is read only"
+	ERROR_COMPRESSING_FILER string = "error compressing filer %s"
+	ERROR_OPENING_ZFILER    string = "error opening compressed filer %s"
+	ERROR_READING_BLOCK     string = "error reading block %d of compressed filer %s"
+)
+
+// block is a compressed run of frames starting at uncompressed position pos
+type block struct {
+	pos, zpos uint64
+}
+
+// zfiler: read only Filer over a block compressed filer file,
+// positions are those of the uncompressed filer
+type zfiler struct {
+	file   File
+	mu     sync.Mutex
+	size   uint64
+	stored uint64
+	blocks []block
+	// index of compressed blocks end
+	indexPos uint64
+
+	// last decompressed block
+	cached int
+	cache  []byte
+}
+
+func newZfiler(f File) (*zfiler, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("zfiler.newZfiler() - error getting file stats, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_NO_FILE, f.Name())
+	}
+	z := &zfiler{
+		file:   f,
+		stored: uint64(fi.Size()),
+		cached: -1,
+	}
+	if z.stored < ZFILER_FOOTER_WIDTH {
+		log.Printf("zfiler.newZfiler() - error missing footer, file: %s", f.Name())
+		return nil, errors.NewAppError(ERROR_OPENING_ZFILER, f.Name())
+	}
+
+	footer := make([]byte, ZFILER_FOOTER_WIDTH)
+	if _, err := f.ReadAt(footer, int64(z.stored-ZFILER_FOOTER_WIDTH)); err != nil {
+		log.Printf("zfiler.newZfiler() - error reading footer, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_OPENING_ZFILER, f.Name())
+	}
+	z.size = ENCODING.Uint64(footer[:8])
+	count := ENCODING.Uint64(footer[8:16])
+	if ENCODING.Uint32(footer[16:]) != ZFILER_MAGIC || count*BLOCK_ENTRY_WIDTH > z.stored-ZFILER_FOOTER_WIDTH {
+		log.Printf("zfiler.newZfiler() - error invalid footer, file: %s", f.Name())
+		return nil, errors.NewAppError(ERROR_OPENING_ZFILER, f.Name())
+	}
+
+	z.indexPos = z.stored - ZFILER_FOOTER_WIDTH - count*BLOCK_ENTRY_WIDTH
+	entries := make([]byte, count*BLOCK_ENTRY_WIDTH)
+	if _, err := f.ReadAt(entries, int64(z.indexPos)); err != nil {
+		log.Printf("zfiler.newZfiler() - error reading block index, error: %v", err)
+		return nil, errors.WrapError(err, ERROR_OPENING_ZFILER, f.Name())
+	}
+	for j := uint64(0); j < count; j++ {
+		e := entries[j*BLOCK_ENTRY_WIDTH:]
+		z.blocks = append(z.blocks, block{
+			pos:  ENCODING.Uint64(e[:8]),
+			zpos: ENCODING.Uint64(e[8:16]),
+		})
+	}
+	return z, nil
+}
+
+// ReadAt reads uncompressed filer bytes, decompressing blocks holding them
+func (z *zfiler) ReadAt(p []byte, off int64) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= z.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(z.blocks), func(i int) bool {
+			return z.blocks[i].pos > pos
+		}) - 1
+		b, err := z.block(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b[pos-z.blocks[i].pos:])
+	}
+	return n, nil
+}
+
+// block returns decompressed block i, reusing the last decompressed block
+func (z *zfiler) block(i int) ([]byte, error) {
+	if i == z.cached {
+		return z.cache, nil
+	}
+	end := z.indexPos
+	if i+1 < len(z.blocks) {
+		end = z.blocks[i+1].zpos
+	}
+	r := flate.NewReader(io.NewSectionReader(z.file, int64(z.blocks[i].zpos), int64(end-z.blocks[i].zpos)))
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("zfiler.block() - error decompressing block, block: %d, error: %v", i, err)
+		return nil, errors.WrapError(err, ERROR_READING_BLOCK, i, z.Name())
+	}
+	z.cached, z.cache = i, b
+	return b, nil
+}
+
+func (z *zfiler) Read(pos uint64) ([]byte, error) {
+	b, _, err := readFrame(z, z.Name(), pos)
+	return b, err
+}
+
+func (z *zfiler) Scan(pos uint64, fn func(pos uint64, record []byte) bool) (uint64, error) {
+	return scanFrames(z, z.Name(), z.size, pos, fn)
+}
+
+func (z *zfiler) Append(record []byte) (n uint64, pos uint64, err error) {
+	return 0, 0, errors.NewAppError(ERROR_READ_ONLY_FILER, z.Name())
+}
+
+func (z *zfiler) Truncate(size int64) error {
+	return errors.NewAppError(ERROR_READ_ONLY_FILER, z.Name())
+}
+
+// Size returns the uncompressed filer size
+func (z *zfiler) Size() uint64 {
+	return z.size
+}
+
+// StoredSize returns the compressed file size
+func (z *zfiler) StoredSize() uint64 {
+	return z.stored
+}
+
+func (z *zfiler) Flush() error {
+	return nil
+}
+
+func (z *zfiler) Sync() error {
+	return nil
+}
+
+func (z *zfiler) Close() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.cached, z.cache = -1, nil
+	return z.file.Close()
+}
+
+func (z *zfiler) Name() string {
+	return z.file.Name()
+}
+
+// compressFiler writes records of filer f to a block compressed filer file at zPath,
+// cutting blocks at record frames once they exceed blockSize bytes
+func compressFiler(fsys FS, f Filer, zPath string, blockSize uint64) error {
+	// block boundaries are record frame positions
+	var starts []uint64
+	var next uint64
+	end, err := f.Scan(0, func(pos uint64, _ []byte) bool {
+		if pos >= next {
+			starts = append(starts, pos)
+			next = pos + blockSize
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if end != f.Size() {
+		log.Printf("zfiler.compressFiler() - error unreadable records, filer: %s, end: %d, size: %d", f.Name(), end, f.Size())
+		return errors.NewAppError(ERROR_COMPRESSING_FILER, f.Name())
+	}
+
+	tmpPath := zPath + TMP_EXT
+	file, err := fsys.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WrapError(err, ERROR_COMPRESSING_FILER, f.Name())
+	}
+	fail := func(err error) error {
+		file.Close()
+		fsys.Remove(tmpPath)
+		log.Printf("zfiler.compressFiler() - error compressing filer %s, error: %v", f.Name(), err)
+		return errors.WrapError(err, ERROR_COMPRESSING_FILER, f.Name())
+	}
+
+	var zpos uint64
+	index := make([]byte, 0, len(starts)*BLOCK_ENTRY_WIDTH)
+	for i, start := range starts {
+		stop := end
+		if i+1 < len(starts) {
+			stop = starts[i+1]
+		}
+		raw := make([]byte, stop-start)
+		if _, err := f.ReadAt(raw, int64(start)); err != nil && err != io.EOF {
+			return fail(err)
+		}
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err = w.Write(raw); err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if _, err = file.Write(buf.Bytes()); err != nil {
+			return fail(err)
+		}
+
+		e := make([]byte, BLOCK_ENTRY_WIDTH)
+		ENCODING.PutUint64(e[:8], start)
+		ENCODING.PutUint64(e[8:], zpos)
+		index = append(index, e...)
+		zpos += uint64(buf.Len())
+	}
+
+	footer := make([]byte, ZFILER_FOOTER_WIDTH)
+	ENCODING.PutUint64(footer[:8], end)
+	ENCODING.PutUint64(footer[8:16], uint64(len(starts)))
+	ENCODING.PutUint32(footer[16:], ZFILER_MAGIC)
+	if _, err = file.Write(append(index, footer...)); err != nil {
+		return fail(err)
+	}
+	if err = file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err = file.Close(); err != nil {
+		fsys.Remove(tmpPath)
+		return errors.WrapError(err, ERROR_COMPRESSING_FILER, f.Name())
+	}
+	if err = fsys.Rename(tmpPath, zPath); err != nil {
+		fsys.Remove(tmpPath)
+		return errors.WrapError(err, ERROR_COMPRESSING_FILER, f.Name())
+	}
+	// compressed filer is durable before the uncompressed filer is removed
+	if err = fsys.SyncDir(path.Dir(zPath)); err != nil {
+		return errors.WrapError(err, ERROR_COMPRESSING_FILER, f.Name())
+	}
+	return nil
+}
+
+// decompressFiler writes uncompressed records of compressed filer z to fPath
+func decompressFiler(fsys FS, z Filer, fPath string) error {
+	tmpPath := fPath + TMP_EXT
+	file, err := fsys.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WrapError(err, ERROR_OPENING_FILER, fPath)
+	}
+	if _, err = io.Copy(file, io.NewSectionReader(z, 0, int64(z.Size()))); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmpPath, fPath)
+	}
+	// decompressed filer is durable before the compressed filer is removed
+	if err == nil {
+		err = fsys.SyncDir(path.Dir(fPath))
+	}
+	if err != nil {
+		log.Printf("zfiler.decompressFiler() - error decompressing filer %s, error: %v", z.Name(), err)
+		fsys.Remove(tmpPath)
+		return errors.WrapError(err, ERROR_OPENING_FILER, fPath)
+	}
+	return nil
+}
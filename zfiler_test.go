@@ -0,0 +1,113 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestZfilerCompressRead(t *testing.T) {
+	fPath := filepath.Join(TEST_DATA_DIR, "compress-read-test"+FILER_EXT)
+	err := createDirectory(fPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	fi, err := os.Create(fPath)
+	require.NoError(t, err)
+	f, err := newFiler(fi)
+	require.NoError(t, err)
+
+	records := [][]byte{}
+	positions := []uint64{}
+	for i := 0; i < 100; i++ {
+		record := []byte(fmt.Sprintf("compressible record %d %s", i, bytes.Repeat([]byte("a"), 100)))
+		_, pos, err := f.Append(record)
+		require.NoError(t, err)
+		records = append(records, record)
+		positions = append(positions, pos)
+	}
+
+	zPath := filepath.Join(TEST_DATA_DIR, "compress-read-test"+ZFILER_EXT)
+	// small blocks, so that records are read across several blocks
+	err = compressFiler(NewOSFS(), f, zPath, 1024)
+	require.NoError(t, err)
+	_, err = os.Stat(zPath + TMP_EXT)
+	require.True(t, os.IsNotExist(err))
+
+	zf, err := openReadFiler(NewOSFS(), zPath)
+	require.NoError(t, err)
+	defer zf.Close()
+	z := zf.(*zfiler)
+	require.Greater(t, len(z.blocks), 1)
+	require.Equal(t, f.Size(), z.Size())
+	require.Less(t, z.StoredSize(), z.Size())
+
+	// records are read in any order
+	for i := len(positions) - 1; i >= 0; i-- {
+		b, err := z.Read(positions[i])
+		require.NoError(t, err)
+		require.Equal(t, records[i], b)
+	}
+
+	var scanned int
+	end, err := z.Scan(0, func(pos uint64, record []byte) bool {
+		require.Equal(t, positions[scanned], pos)
+		require.Equal(t, records[scanned], record)
+		scanned++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(records), scanned)
+	require.Equal(t, z.Size(), end)
+
+	// uncompressed bytes read across blocks
+	want := make([]byte, f.Size())
+	_, err = f.ReadAt(want, 0)
+	require.NoError(t, err)
+	got := make([]byte, z.Size())
+	_, err = z.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	_, _, err = z.Append(records[0])
+	require.Error(t, err)
+	err = z.Truncate(0)
+	require.Error(t, err)
+
+	// decompressed filer matches the original
+	dPath := filepath.Join(TEST_DATA_DIR, "decompress-read-test"+FILER_EXT)
+	err = decompressFiler(NewOSFS(), z, dPath)
+	require.NoError(t, err)
+	d, err := openReadFiler(NewOSFS(), dPath)
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, f.Size(), d.Size())
+	b, err := d.Read(positions[50])
+	require.NoError(t, err)
+	require.Equal(t, records[50], b)
+
+	err = f.Close()
+	require.NoError(t, err)
+}
+
+func TestZfilerCorruptFooter(t *testing.T) {
+	zPath := filepath.Join(TEST_DATA_DIR, "corrupt-footer-test"+ZFILER_EXT)
+	err := createDirectory(zPath)
+	require.NoError(t, err)
+	defer func() {
+		err = os.RemoveAll(TEST_DATA_DIR)
+		require.NoError(t, err)
+	}()
+
+	err = os.WriteFile(zPath, bytes.Repeat([]byte{1}, ZFILER_FOOTER_WIDTH+BLOCK_ENTRY_WIDTH), 0644)
+	require.NoError(t, err)
+	_, err = openReadFiler(NewOSFS(), zPath)
+	require.Error(t, err)
+}